@@ -0,0 +1,334 @@
+// Package admin provides an HTTP API to inspect and control rebot at
+// runtime.
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/m-lab/rebot/history"
+	"github.com/m-lab/rebot/node"
+	log "github.com/sirupsen/logrus"
+)
+
+// Controller is implemented by the component running rebot's reboot loop.
+// Its methods must be safe to call concurrently with the loop.
+type Controller interface {
+	// Candidates returns the verdicts of the last check.
+	Candidates() []node.Verdict
+
+	// History returns a copy of the current history.
+	History() map[string]node.History
+
+	// Events returns the events matching the query.
+	Events(q history.Query) ([]history.Event, error)
+
+	// Clear removes a node from the history, so that its cooldown does not
+	// apply anymore. It returns false if the node was not in the history.
+	Clear(machine string) bool
+
+	// Pause stops automated reboots, while detection keeps running.
+	Pause()
+
+	// Resume restarts automated reboots.
+	Resume()
+
+	// Paused returns true if automated reboots are paused.
+	Paused() bool
+
+	// Check triggers an immediate check cycle. It does not wait for the
+	// cycle to complete.
+	Check()
+
+	// Reboot reboots a node on behalf of author and records it in the
+	// history. Unless force is true, it returns a *RefusedError if the node
+	// cannot be rebooted according to its history, the schedule or the
+	// reboot budget.
+	Reboot(n node.Node, force bool, author string) (node.History, error)
+
+	// Silences returns the silences that have not expired.
+	Silences() []history.Silence
+
+	// Silence adds a silence and returns it with its ID.
+	Silence(s history.Silence) (history.Silence, error)
+
+	// Unsilence removes the silence with the given ID. It returns false if
+	// there is no such silence.
+	Unsilence(id string) (bool, error)
+}
+
+// RefusedError is returned by Controller.Reboot when a reboot is refused by
+// the safety checks, e.g. the cooldown policy. It can be overridden with
+// force.
+type RefusedError struct {
+	Reason string
+}
+
+func (e *RefusedError) Error() string {
+	return "reboot refused: " + e.Reason
+}
+
+// Status is the response of the /status endpoint.
+type Status struct {
+	Paused bool `json:"paused"`
+}
+
+// Handler serves the admin API.
+type Handler struct {
+	controller Controller
+	username   string
+	password   string
+	mux        *http.ServeMux
+}
+
+// NewHandler returns a Handler for the given Controller. If username and
+// password are not empty, requests must use HTTP basic authentication.
+//
+// The endpoints are:
+//
+//	GET  /candidates        verdicts of the last check
+//	GET  /history           the history of every node
+//	GET  /events            events, filtered by machine, site, from and to
+//	                        (RFC3339) query parameters
+//	POST /clear?machine=X   clear the history of a node
+//	GET  /status            whether automated reboots are paused
+//	POST /pause             pause automated reboots
+//	POST /resume            resume automated reboots
+//	POST /check             trigger an immediate check cycle
+//	POST /reboot?machine=X  reboot a node, bypassing the cooldown if the
+//	                        force parameter is true
+//	GET  /silences          the silences that have not expired
+//	POST /silences          add the silence in the JSON request body
+//	DELETE /silences?id=X   remove a silence
+func NewHandler(c Controller, username, password string) *Handler {
+	h := &Handler{
+		controller: c,
+		username:   username,
+		password:   password,
+		mux:        http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("/candidates", h.method(http.MethodGet, h.candidates))
+	h.mux.HandleFunc("/history", h.method(http.MethodGet, h.history))
+	h.mux.HandleFunc("/events", h.method(http.MethodGet, h.events))
+	h.mux.HandleFunc("/clear", h.method(http.MethodPost, h.clear))
+	h.mux.HandleFunc("/status", h.method(http.MethodGet, h.status))
+	h.mux.HandleFunc("/pause", h.method(http.MethodPost, h.pause))
+	h.mux.HandleFunc("/resume", h.method(http.MethodPost, h.resume))
+	h.mux.HandleFunc("/check", h.method(http.MethodPost, h.check))
+	h.mux.HandleFunc("/reboot", h.method(http.MethodPost, h.reboot))
+	h.mux.HandleFunc("/silences", h.silences)
+
+	return h
+}
+
+// ServeHTTP checks the credentials, if configured, and dispatches the
+// request to the corresponding endpoint.
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if h.username != "" && h.password != "" {
+		user, pass, ok := req.BasicAuth()
+		if !ok || user != h.username || pass != h.password {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="rebot"`)
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	h.mux.ServeHTTP(rw, req)
+}
+
+// method wraps a handler so that it only accepts the given HTTP method.
+func (h *Handler) method(m string, f http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != m {
+			rw.Header().Set("Allow", m)
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		f(rw, req)
+	}
+}
+
+func (h *Handler) candidates(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, http.StatusOK, h.controller.Candidates())
+}
+
+func (h *Handler) history(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, http.StatusOK, h.controller.History())
+}
+
+func (h *Handler) events(rw http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	q := history.Query{
+		Machine: params.Get("machine"),
+		Site:    params.Get("site"),
+	}
+
+	var err error
+	for name, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if v := params.Get(name); v != "" {
+			*t, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(rw, "invalid "+name+": "+err.Error(),
+					http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	events, err := h.controller.Events(q)
+	if err != nil {
+		log.WithError(err).Error("Cannot read the event log.")
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(rw, http.StatusOK, events)
+}
+
+func (h *Handler) clear(rw http.ResponseWriter, req *http.Request) {
+	machine := req.URL.Query().Get("machine")
+	if machine == "" {
+		http.Error(rw, "URL parameter 'machine' is missing",
+			http.StatusBadRequest)
+		return
+	}
+
+	log.WithFields(log.Fields{"machine": machine, "remote": req.RemoteAddr}).Info("Clear requested via the admin API.")
+	if !h.controller.Clear(machine) {
+		http.Error(rw, "machine not found in history", http.StatusNotFound)
+		return
+	}
+	writeJSON(rw, http.StatusOK, h.controller.History())
+}
+
+func (h *Handler) status(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, http.StatusOK, Status{Paused: h.controller.Paused()})
+}
+
+func (h *Handler) pause(rw http.ResponseWriter, req *http.Request) {
+	log.WithField("remote", req.RemoteAddr).Info("Reboots paused via the admin API.")
+	h.controller.Pause()
+	writeJSON(rw, http.StatusOK, Status{Paused: h.controller.Paused()})
+}
+
+func (h *Handler) resume(rw http.ResponseWriter, req *http.Request) {
+	log.WithField("remote", req.RemoteAddr).Info("Reboots resumed via the admin API.")
+	h.controller.Resume()
+	writeJSON(rw, http.StatusOK, Status{Paused: h.controller.Paused()})
+}
+
+func (h *Handler) check(rw http.ResponseWriter, req *http.Request) {
+	log.WithField("remote", req.RemoteAddr).Info("Check triggered via the admin API.")
+	h.controller.Check()
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) reboot(rw http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	n, err := node.Parse(params.Get("machine"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	force := false
+	if v := params.Get("force"); v != "" {
+		force, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(rw, "invalid force: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	hist, err := h.controller.Reboot(n, force, author(req))
+	if err != nil {
+		code := http.StatusBadGateway
+		if _, ok := err.(*RefusedError); ok {
+			code = http.StatusConflict
+		}
+		http.Error(rw, err.Error(), code)
+		return
+	}
+	writeJSON(rw, http.StatusOK, hist)
+}
+
+func (h *Handler) silences(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(rw, http.StatusOK, h.controller.Silences())
+
+	case http.MethodPost:
+		var s history.Silence
+		err := json.NewDecoder(req.Body).Decode(&s)
+		if err != nil {
+			http.Error(rw, "invalid silence: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.Author == "" {
+			s.Author = author(req)
+		}
+		if err = s.Validate(); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s, err = h.controller.Silence(s)
+		if err != nil {
+			log.WithError(err).Error("Cannot add the silence.")
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, http.StatusOK, s)
+
+	case http.MethodDelete:
+		id := req.URL.Query().Get("id")
+		if id == "" {
+			http.Error(rw, "URL parameter 'id' is missing", http.StatusBadRequest)
+			return
+		}
+
+		found, err := h.controller.Unsilence(id)
+		if err != nil {
+			log.WithError(err).Error("Cannot remove the silence.")
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(rw, "silence not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(rw, http.StatusOK, h.controller.Silences())
+
+	default:
+		rw.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// author returns who made the request: the author parameter, or the
+// username used to authenticate, followed by the remote address.
+func author(req *http.Request) string {
+	name := req.URL.Query().Get("author")
+	if name == "" {
+		name, _, _ = req.BasicAuth()
+	}
+	if name == "" {
+		return req.RemoteAddr
+	}
+	return name + " (" + req.RemoteAddr + ")"
+}
+
+// writeJSON writes v as the JSON body of the response.
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	rw.Write(content)
+}
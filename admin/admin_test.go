@@ -0,0 +1,450 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/rebot/history"
+	"github.com/m-lab/rebot/node"
+)
+
+// fakeController records the calls made by the Handler.
+type fakeController struct {
+	paused  bool
+	checked bool
+	cleared string
+	forced  bool
+	author  string
+	query   history.Query
+	err     error
+	history map[string]node.History
+
+	silences []history.Silence
+}
+
+func (c *fakeController) Candidates() []node.Verdict {
+	return []node.Verdict{{
+		Node:    node.Node{Name: "mlab1.lga0t.measurement-lab.org", Site: "lga0t"},
+		Reasons: []string{"ssh-down"},
+	}}
+}
+
+func (c *fakeController) History() map[string]node.History {
+	return c.history
+}
+
+func (c *fakeController) Events(q history.Query) ([]history.Event, error) {
+	c.query = q
+	if c.err != nil {
+		return nil, c.err
+	}
+	return []history.Event{{Type: history.EventCandidate}}, nil
+}
+
+func (c *fakeController) Clear(machine string) bool {
+	if _, ok := c.history[machine]; !ok {
+		return false
+	}
+	c.cleared = machine
+	delete(c.history, machine)
+	return true
+}
+
+func (c *fakeController) Pause()       { c.paused = true }
+func (c *fakeController) Resume()      { c.paused = false }
+func (c *fakeController) Paused() bool { return c.paused }
+func (c *fakeController) Check()       { c.checked = true }
+
+func (c *fakeController) Reboot(n node.Node, force bool, author string) (node.History, error) {
+	c.forced = force
+	c.author = author
+	if c.err != nil {
+		return node.History{}, c.err
+	}
+	if _, ok := c.history[n.Name]; ok && !force {
+		return node.History{}, &RefusedError{Reason: "rebooted recently"}
+	}
+	return node.NewHistory(n.Name, n.Site, time.Now()), nil
+}
+
+func (c *fakeController) Silences() []history.Silence {
+	return c.silences
+}
+
+func (c *fakeController) Silence(s history.Silence) (history.Silence, error) {
+	if c.err != nil {
+		return history.Silence{}, c.err
+	}
+	s.ID = "1234"
+	c.silences = append(c.silences, s)
+	return s, nil
+}
+
+func (c *fakeController) Unsilence(id string) (bool, error) {
+	if c.err != nil {
+		return false, c.err
+	}
+	for i, s := range c.silences {
+		if s.ID == id {
+			c.silences = append(c.silences[:i], c.silences[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func newFakeController() *fakeController {
+	return &fakeController{
+		paused: true,
+		history: map[string]node.History{
+			"mlab1.lga0t.measurement-lab.org": node.NewHistory(
+				"mlab1.lga0t.measurement-lab.org", "lga0t", time.Now()),
+		},
+		silences: []history.Silence{{ID: "abcd", Site: "lga.*"}},
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		body     string
+		user     string
+		pass     string
+		err      error
+		wantCode int
+		check    func(t *testing.T, c *fakeController, body []byte)
+	}{
+		{
+			name:     "candidates",
+			method:   http.MethodGet,
+			url:      "/candidates",
+			wantCode: http.StatusOK,
+			check: func(t *testing.T, c *fakeController, body []byte) {
+				var v []node.Verdict
+				if err := json.Unmarshal(body, &v); err != nil || len(v) != 1 {
+					t.Errorf("/candidates returned %s", body)
+				}
+			},
+		},
+		{
+			name:     "history",
+			method:   http.MethodGet,
+			url:      "/history",
+			wantCode: http.StatusOK,
+			check: func(t *testing.T, c *fakeController, body []byte) {
+				var h map[string]node.History
+				if err := json.Unmarshal(body, &h); err != nil || len(h) != 1 {
+					t.Errorf("/history returned %s", body)
+				}
+			},
+		},
+		{
+			name:     "events",
+			method:   http.MethodGet,
+			url:      "/events?machine=mlab1&site=lga0t&from=2019-01-01T00:00:00Z",
+			wantCode: http.StatusOK,
+			check: func(t *testing.T, c *fakeController, body []byte) {
+				want := history.Query{
+					Machine: "mlab1",
+					Site:    "lga0t",
+					From:    time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC),
+				}
+				if !reflect.DeepEqual(c.query, want) {
+					t.Errorf("/events used query %v, want %v", c.query, want)
+				}
+			},
+		},
+		{
+			name:     "events-invalid-time",
+			method:   http.MethodGet,
+			url:      "/events?to=yesterday",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "events-error",
+			method:   http.MethodGet,
+			url:      "/events",
+			err:      errors.New("read error"),
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "clear",
+			method:   http.MethodPost,
+			url:      "/clear?machine=mlab1.lga0t.measurement-lab.org",
+			wantCode: http.StatusOK,
+			check: func(t *testing.T, c *fakeController, body []byte) {
+				if c.cleared != "mlab1.lga0t.measurement-lab.org" {
+					t.Errorf("/clear did not clear the node")
+				}
+			},
+		},
+		{
+			name:     "clear-not-found",
+			method:   http.MethodPost,
+			url:      "/clear?machine=mlab2.lga0t.measurement-lab.org",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "clear-missing-machine",
+			method:   http.MethodPost,
+			url:      "/clear",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "clear-wrong-method",
+			method:   http.MethodGet,
+			url:      "/clear?machine=mlab1.lga0t.measurement-lab.org",
+			wantCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:     "status",
+			method:   http.MethodGet,
+			url:      "/status",
+			wantCode: http.StatusOK,
+			check: func(t *testing.T, c *fakeController, body []byte) {
+				var s Status
+				if err := json.Unmarshal(body, &s); err != nil || !s.Paused {
+					t.Errorf("/status returned %s", body)
+				}
+			},
+		},
+		{
+			name:     "pause",
+			method:   http.MethodPost,
+			url:      "/pause",
+			wantCode: http.StatusOK,
+			check: func(t *testing.T, c *fakeController, body []byte) {
+				if !c.paused {
+					t.Errorf("/pause did not pause reboots")
+				}
+			},
+		},
+		{
+			name:     "resume",
+			method:   http.MethodPost,
+			url:      "/resume",
+			wantCode: http.StatusOK,
+			check: func(t *testing.T, c *fakeController, body []byte) {
+				if c.paused {
+					t.Errorf("/resume did not resume reboots")
+				}
+			},
+		},
+		{
+			name:     "check",
+			method:   http.MethodPost,
+			url:      "/check",
+			wantCode: http.StatusAccepted,
+			check: func(t *testing.T, c *fakeController, body []byte) {
+				if !c.checked {
+					t.Errorf("/check did not trigger a check")
+				}
+			},
+		},
+		{
+			name:     "reboot",
+			method:   http.MethodPost,
+			url:      "/reboot?machine=mlab2.lga0t&author=alice",
+			wantCode: http.StatusOK,
+			check: func(t *testing.T, c *fakeController, body []byte) {
+				var h node.History
+				if err := json.Unmarshal(body, &h); err != nil ||
+					h.Name != "mlab2.lga0t.measurement-lab.org" || h.Site != "lga0t" {
+					t.Errorf("/reboot returned %s", body)
+				}
+				if c.forced || c.author != "alice (192.0.2.1:1234)" {
+					t.Errorf("/reboot called Reboot with force %v, author %q",
+						c.forced, c.author)
+				}
+			},
+		},
+		{
+			name:     "reboot-refused",
+			method:   http.MethodPost,
+			url:      "/reboot?machine=mlab1.lga0t",
+			wantCode: http.StatusConflict,
+		},
+		{
+			name:     "reboot-forced",
+			method:   http.MethodPost,
+			url:      "/reboot?machine=mlab1.lga0t&force=true",
+			wantCode: http.StatusOK,
+			check: func(t *testing.T, c *fakeController, body []byte) {
+				if !c.forced {
+					t.Errorf("/reboot did not force the reboot")
+				}
+			},
+		},
+		{
+			name:     "reboot-invalid-machine",
+			method:   http.MethodPost,
+			url:      "/reboot?machine=invalid",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "reboot-invalid-force",
+			method:   http.MethodPost,
+			url:      "/reboot?machine=mlab1.lga0t&force=maybe",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "reboot-failed",
+			method:   http.MethodPost,
+			url:      "/reboot?machine=mlab2.lga0t",
+			err:      errors.New("reboot failed"),
+			wantCode: http.StatusBadGateway,
+		},
+		{
+			name:     "silences",
+			method:   http.MethodGet,
+			url:      "/silences",
+			wantCode: http.StatusOK,
+			check: func(t *testing.T, c *fakeController, body []byte) {
+				var s []history.Silence
+				if err := json.Unmarshal(body, &s); err != nil || len(s) != 1 {
+					t.Errorf("/silences returned %s", body)
+				}
+			},
+		},
+		{
+			name:     "silences-add",
+			method:   http.MethodPost,
+			url:      "/silences",
+			body:     `{"machine": "mlab1.lga0t", "expires": "2030-01-01T00:00:00Z", "comment": "flaky"}`,
+			wantCode: http.StatusOK,
+			check: func(t *testing.T, c *fakeController, body []byte) {
+				var s history.Silence
+				if err := json.Unmarshal(body, &s); err != nil || s.ID != "1234" ||
+					s.Author != "192.0.2.1:1234" {
+					t.Errorf("/silences returned %s", body)
+				}
+			},
+		},
+		{
+			name:     "silences-add-invalid-json",
+			method:   http.MethodPost,
+			url:      "/silences",
+			body:     `{`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "silences-add-invalid-silence",
+			method:   http.MethodPost,
+			url:      "/silences",
+			body:     `{"expires": "2030-01-01T00:00:00Z"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "silences-add-error",
+			method:   http.MethodPost,
+			url:      "/silences",
+			body:     `{"site": "lga.*", "expires": "2030-01-01T00:00:00Z"}`,
+			err:      errors.New("write error"),
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "silences-delete",
+			method:   http.MethodDelete,
+			url:      "/silences?id=abcd",
+			wantCode: http.StatusOK,
+			check: func(t *testing.T, c *fakeController, body []byte) {
+				if len(c.silences) != 0 {
+					t.Errorf("/silences did not remove the silence")
+				}
+			},
+		},
+		{
+			name:     "silences-delete-not-found",
+			method:   http.MethodDelete,
+			url:      "/silences?id=notfound",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "silences-delete-missing-id",
+			method:   http.MethodDelete,
+			url:      "/silences",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "silences-delete-error",
+			method:   http.MethodDelete,
+			url:      "/silences?id=abcd",
+			err:      errors.New("write error"),
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "silences-wrong-method",
+			method:   http.MethodPut,
+			url:      "/silences",
+			wantCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:     "not-found",
+			method:   http.MethodGet,
+			url:      "/notfound",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "auth-success",
+			method:   http.MethodGet,
+			url:      "/status",
+			user:     "user",
+			pass:     "pass",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "auth-wrong-password",
+			method:   http.MethodGet,
+			url:      "/status",
+			user:     "user",
+			pass:     "wrong",
+			wantCode: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeController()
+			c.err = tt.err
+
+			var h *Handler
+			if tt.user != "" {
+				h = NewHandler(c, "user", "pass")
+			} else {
+				h = NewHandler(c, "", "")
+			}
+
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			if rw.Code != tt.wantCode {
+				t.Errorf("%s %s returned %d, want %d", tt.method, tt.url,
+					rw.Code, tt.wantCode)
+			}
+			if tt.check != nil {
+				tt.check(t, c, rw.Body.Bytes())
+			}
+		})
+	}
+
+	t.Run("auth-missing", func(t *testing.T) {
+		h := NewHandler(newFakeController(), "user", "pass")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/status", nil))
+		if rw.Code != http.StatusUnauthorized {
+			t.Errorf("unauthenticated request returned %d, want %d", rw.Code,
+				http.StatusUnauthorized)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/m-lab/rebot/history"
+	"github.com/m-lab/rebot/node"
+)
+
+// Client sends requests to the admin API of a running rebot instance.
+type Client struct {
+	baseURL  string
+	username string
+	password string
+	client   *http.Client
+}
+
+// NewClient returns a Client for the admin API listening on addr. If
+// username and password are not empty, they are sent with every request.
+func NewClient(c *http.Client, addr, username, password string) *Client {
+	baseURL := addr
+	if !strings.HasPrefix(baseURL, "http://") &&
+		!strings.HasPrefix(baseURL, "https://") {
+		baseURL = "http://" + baseURL
+	}
+	return &Client{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		username: username,
+		password: password,
+		client:   c,
+	}
+}
+
+// Reboot asks rebot to reboot the machine on behalf of author, bypassing
+// the cooldown if force is true, and returns the updated history of the
+// node.
+func (c *Client) Reboot(machine string, force bool, author string) (node.History, error) {
+	params := url.Values{}
+	params.Set("machine", machine)
+	params.Set("force", strconv.FormatBool(force))
+	if author != "" {
+		params.Set("author", author)
+	}
+
+	var hist node.History
+	err := c.do(http.MethodPost, "/reboot", params, nil, &hist)
+	return hist, err
+}
+
+// Silences returns the silences that have not expired.
+func (c *Client) Silences() ([]history.Silence, error) {
+	var silences []history.Silence
+	err := c.do(http.MethodGet, "/silences", nil, nil, &silences)
+	return silences, err
+}
+
+// Silence adds a silence and returns it with its ID.
+func (c *Client) Silence(s history.Silence) (history.Silence, error) {
+	var added history.Silence
+	err := c.do(http.MethodPost, "/silences", nil, s, &added)
+	return added, err
+}
+
+// Unsilence removes the silence with the given ID.
+func (c *Client) Unsilence(id string) error {
+	params := url.Values{}
+	params.Set("id", id)
+	return c.do(http.MethodDelete, "/silences", params, nil, nil)
+}
+
+// do sends a request to the endpoint, with body encoded as JSON if not nil,
+// and decodes the JSON response into v.
+func (c *Client) do(method, endpoint string, params url.Values, body, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+endpoint+"?"+params.Encode(), reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.username != "" && c.password != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(content)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(content, v)
+}
@@ -0,0 +1,70 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m-lab/rebot/history"
+)
+
+func TestClient_Reboot(t *testing.T) {
+	c := newFakeController()
+	srv := httptest.NewServer(NewHandler(c, "user", "pass"))
+	defer srv.Close()
+
+	client := NewClient(http.DefaultClient, srv.URL, "user", "pass")
+	hist, err := client.Reboot("mlab2.lga0t", false, "alice")
+	if err != nil {
+		t.Fatalf("Reboot() error = %v", err)
+	}
+	if hist.Name != "mlab2.lga0t.measurement-lab.org" {
+		t.Errorf("Reboot() = %v, want history of mlab2.lga0t", hist)
+	}
+
+	_, err = client.Reboot("mlab1.lga0t", false, "alice")
+	if err == nil {
+		t.Errorf("Reboot() of a recently rebooted machine did not fail")
+	}
+
+	_, err = client.Reboot("mlab1.lga0t", true, "alice")
+	if err != nil || !c.forced {
+		t.Errorf("Reboot() with force error = %v, forced = %v", err, c.forced)
+	}
+
+	// Without credentials the request must fail.
+	client = NewClient(http.DefaultClient, srv.URL, "", "")
+	_, err = client.Reboot("mlab2.lga0t", false, "alice")
+	if err == nil {
+		t.Errorf("Reboot() without credentials did not fail")
+	}
+}
+
+func TestClient_Silences(t *testing.T) {
+	c := newFakeController()
+	srv := httptest.NewServer(NewHandler(c, "", ""))
+	defer srv.Close()
+
+	client := NewClient(http.DefaultClient, srv.URL, "", "")
+	added, err := client.Silence(history.Silence{
+		Machine: "mlab1.lga0t",
+		Expires: time.Now().Add(time.Hour),
+		Author:  "alice",
+	})
+	if err != nil || added.ID != "1234" {
+		t.Errorf("Silence() = %v, %v", added, err)
+	}
+
+	silences, err := client.Silences()
+	if err != nil || len(silences) != 2 {
+		t.Errorf("Silences() = %v, %v, want two silences", silences, err)
+	}
+
+	if err = client.Unsilence("abcd"); err != nil {
+		t.Errorf("Unsilence() error = %v", err)
+	}
+	if err = client.Unsilence("abcd"); err == nil {
+		t.Errorf("Unsilence() of a removed silence did not fail")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/m-lab/rebot/admin"
+	"github.com/m-lab/rebot/history"
+)
+
+// commandOutput is where subcommands write their results.
+var commandOutput io.Writer = os.Stdout
+
+// runCommand runs the subcommand named by the first argument, sending
+// requests to the admin API at -admin.addr. Requests wait as long as the
+// admin server may take to answer: a manual reboot waits for the running
+// check, and giving up earlier would not stop the reboot on the server.
+func runCommand(args []string) error {
+	client := admin.NewClient(&http.Client{Timeout: adminWriteTimeout},
+		adminAddr, adminUsername, adminPassword)
+
+	switch args[0] {
+	case "reboot":
+		return rebootCommand(client, args[1:])
+	case "silence":
+		return silenceCommand(client, args[1:])
+	case "silences":
+		return silencesCommand(client, args[1:])
+	case "unsilence":
+		return unsilenceCommand(client, args[1:])
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+// rebootCommand implements "rebot reboot [-force] [-author name] <machine>".
+func rebootCommand(client *admin.Client, args []string) error {
+	fs := flag.NewFlagSet("reboot", flag.ContinueOnError)
+	force := fs.Bool("force", false,
+		"Reboot even if the machine was rebooted recently.")
+	author := fs.String("author", os.Getenv("USER"),
+		"Name recorded in the event log as the requester.")
+
+	// Flags are allowed both before and after the machine name.
+	var machines []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		machines = append(machines, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(machines) != 1 {
+		return errors.New("usage: rebot reboot [-force] [-author name] <machine>")
+	}
+
+	hist, err := client.Reboot(machines[0], *force, *author)
+	if err != nil {
+		return err
+	}
+	return printJSON(hist)
+}
+
+// silenceCommand implements "rebot silence [-machine name] [-site regexp]
+// [-label name=value]... -duration d -comment text [-author name]".
+func silenceCommand(client *admin.Client, args []string) error {
+	s := history.Silence{Labels: map[string]string{}}
+	fs := flag.NewFlagSet("silence", flag.ContinueOnError)
+	fs.StringVar(&s.Machine, "machine", "", "Machine to silence.")
+	fs.StringVar(&s.Site, "site", "",
+		"Regular expression matching the sites to silence.")
+	fs.Var(labelsFlag(s.Labels), "label",
+		"Label, as name=value, of the machines to silence. Can be repeated.")
+	fs.StringVar(&s.Author, "author", os.Getenv("USER"),
+		"Author of the silence.")
+	fs.StringVar(&s.Comment, "comment", "", "Why the machines are silenced.")
+	duration := fs.Duration("duration", 24*time.Hour,
+		"How long the silence lasts.")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	s.Expires = time.Now().Add(*duration)
+
+	added, err := client.Silence(s)
+	if err != nil {
+		return err
+	}
+	return printJSON(added)
+}
+
+// silencesCommand implements "rebot silences".
+func silencesCommand(client *admin.Client, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: rebot silences")
+	}
+
+	silences, err := client.Silences()
+	if err != nil {
+		return err
+	}
+	return printJSON(silences)
+}
+
+// unsilenceCommand implements "rebot unsilence <id>".
+func unsilenceCommand(client *admin.Client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: rebot unsilence <id>")
+	}
+	return client.Unsilence(args[0])
+}
+
+// labelsFlag is a flag.Value adding name=value pairs to a map.
+type labelsFlag map[string]string
+
+func (l labelsFlag) String() string {
+	return fmt.Sprint(map[string]string(l))
+}
+
+func (l labelsFlag) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("invalid label %q, want name=value", value)
+	}
+	l[kv[0]] = kv[1]
+	return nil
+}
+
+// printJSON writes v to commandOutput as indented JSON.
+func printJSON(v interface{}) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(commandOutput, string(content))
+	return err
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/m-lab/rebot/admin"
+	"github.com/m-lab/rebot/history"
+	"github.com/m-lab/rebot/node"
+	log "github.com/sirupsen/logrus"
+)
+
+// manualReason is the reason recorded in the history for reboots requested
+// by an operator.
+const manualReason = "manual"
+
+// stopGrace is how long Stop waits for a cancelled check to record the
+// results of its requests. This can be swapped to simplify unit testing.
+var stopGrace = 10 * time.Second
+
+// controller holds the state shared between the reboot loop and the admin
+// API.
+//
+// mu is held for a whole check cycle and by the operations changing the
+// history, and protects history, stopped, queue and timer. The state the
+// admin API reads is protected by stateMu instead, which is only held
+// briefly, so that reading it or pausing reboots does not wait for the
+// running cycle.
+type controller struct {
+	mu sync.Mutex
+
+	// Context of the Prometheus queries and reboot requests, cancelled if
+	// the running check does not complete before the shutdown deadline.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	history  map[string]node.History
+	rebooter Rebooter
+	stopped  bool
+
+	// Nodes whose reboot is held by the maintenance schedule, and the timer
+	// triggering a check when the first of them can be rebooted.
+	queue map[string]node.Verdict
+	timer *time.Timer
+
+	stateMu sync.Mutex
+
+	// The verdicts of the last check, and a copy of the history taken at
+	// the end of the last change.
+	verdicts []node.Verdict
+	snapshot map[string]node.History
+	paused   bool
+}
+
+// newController returns a controller using the provided history and
+// rebooter.
+func newController(h map[string]node.History, rebooter Rebooter) *controller {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &controller{
+		ctx:      ctx,
+		cancel:   cancel,
+		history:  h,
+		rebooter: rebooter,
+		verdicts: []node.Verdict{},
+		queue:    map[string]node.Verdict{},
+	}
+	c.publish()
+	return c
+}
+
+// publish makes a copy of the history available to History. The caller
+// must hold c.mu.
+func (c *controller) publish() {
+	h := make(map[string]node.History, len(c.history))
+	for k, v := range c.history {
+		h[k] = v
+	}
+
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.snapshot = h
+}
+
+// setVerdicts records the verdicts of the last check.
+func (c *controller) setVerdicts(verdicts []node.Verdict) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	c.verdicts = verdicts
+}
+
+// run runs a check cycle, unless the controller is stopped.
+func (c *controller) run() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped {
+		log.Info("Rebot is shutting down - not running the check.")
+		return
+	}
+	c.checkAndReboot()
+	c.publish()
+}
+
+// Stop waits for the running check cycle, if any, to complete, then stops
+// the controller and writes the history. No check runs after that. It
+// returns ctx's error if the check did not complete before ctx is done, in
+// which case its pending queries and requests are cancelled and Stop waits
+// for up to stopGrace more, so that the check records the reboots already
+// sent and the history is written.
+func (c *controller) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.stopped = true
+		if c.timer != nil {
+			c.timer.Stop()
+			c.timer = nil
+		}
+		if !dryRun {
+			writeHistory(c.history)
+		}
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	c.cancel()
+	select {
+	case <-done:
+	case <-time.After(stopGrace):
+		log.Error("The cancelled check did not complete, its reboots may be " +
+			"missing from the history.")
+	}
+	return ctx.Err()
+}
+
+// Candidates returns the verdicts of the last check.
+func (c *controller) Candidates() []node.Verdict {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return append([]node.Verdict{}, c.verdicts...)
+}
+
+// History returns a copy of the history as of the end of the last check or
+// change: the changes made by a running check are not visible until it
+// completes.
+func (c *controller) History() map[string]node.History {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	h := make(map[string]node.History, len(c.snapshot))
+	for k, v := range c.snapshot {
+		h[k] = v
+	}
+	return h
+}
+
+// Events returns the events in the event log matching the query.
+func (c *controller) Events(q history.Query) ([]history.Event, error) {
+	if eventLog == nil {
+		return []history.Event{}, nil
+	}
+	return eventLog.Read(q)
+}
+
+// Clear removes a node from the history, closes its issue and persists the
+// change.
+func (c *controller) Clear(machine string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hist, ok := history.Clear(machine, c.history)
+	if !ok {
+		return false
+	}
+	if !dryRun {
+		tickets.Close(hist, fmt.Sprintf("The history of %s was cleared by an "+
+			"operator.", machine))
+	}
+	writeHistory(c.history)
+	c.publish()
+	return true
+}
+
+// Pause stops automated reboots, including those of the running check that
+// have not been sent yet.
+func (c *controller) Pause() {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	c.paused = true
+}
+
+// Resume restarts automated reboots.
+func (c *controller) Resume() {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	c.paused = false
+}
+
+// Paused returns true if automated reboots are paused.
+func (c *controller) Paused() bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return c.paused
+}
+
+// Check runs a check cycle in the background.
+func (c *controller) Check() {
+	go c.run()
+}
+
+// Reboot reboots a node on behalf of an operator, recording it in the
+// history as an automated reboot would be. Unless force is true, silences,
+// the cooldown policy, the maintenance schedule and the budget's window and
+// sequence limits apply; a forced reboot is logged as such in the event log.
+func (c *controller) Reboot(n node.Node, force bool, author string) (node.History, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if dryRun {
+		return node.History{}, errors.New("dry run - not rebooting")
+	}
+	if c.stopped {
+		return node.History{}, errors.New("rebot is shutting down - not rebooting")
+	}
+
+	now := time.Now()
+	v := node.Verdict{Node: n, Reasons: []string{manualReason}}
+	reason := skipReason(v, c.history)
+	if reason == "" {
+		reason = maintenance.HoldReason(n, project, now)
+	}
+	if reason == "" {
+		_, over := budget.Allocate([]node.Verdict{v}, c.history, now)
+		if limit := over[n.Name]; limit == history.LimitSequence || limit == history.LimitWindow {
+			reason = fmt.Sprintf("over budget: %s limit reached", limit)
+		}
+	}
+	if reason != "" && !force {
+		return node.History{}, &admin.RefusedError{Reason: reason}
+	}
+
+	audit := history.NewEvent(history.EventManualReboot, n)
+	audit.Reason = "requested by " + author
+	fields := log.Fields{"machine": n.Name, "author": author}
+	if reason != "" {
+		audit.Reason += ", forced: " + reason
+		fields["bypassed"] = reason
+	}
+	log.WithFields(fields).Warn("Manual reboot requested.")
+	recordEvents(audit)
+
+	result := c.sendReboots([]node.Verdict{v})
+	writeHistory(c.history)
+	c.publish()
+
+	if err, ok := result.Failed[n.Name]; ok {
+		return c.history[n.Name], err
+	}
+	return c.history[n.Name], nil
+}
+
+// Silences returns the silences that have not expired.
+func (c *controller) Silences() []history.Silence {
+	if silences == nil {
+		return []history.Silence{}
+	}
+	return silences.List()
+}
+
+// Silence adds a silence.
+func (c *controller) Silence(s history.Silence) (history.Silence, error) {
+	if silences == nil {
+		return history.Silence{}, errors.New("silences are not enabled")
+	}
+	return silences.Add(s)
+}
+
+// Unsilence removes a silence.
+func (c *controller) Unsilence(id string) (bool, error) {
+	if silences == nil {
+		return false, nil
+	}
+	return silences.Remove(id)
+}
@@ -0,0 +1,379 @@
+package healthcheck
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+	"time"
+
+	"github.com/m-lab/rebot/promtest"
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kind is the kind of a Criterion.
+type Kind string
+
+const (
+	// Inclusion criteria select machines that should be rebooted.
+	Inclusion = Kind("inclusion")
+
+	// Exclusion criteria prevent otherwise selected machines from being
+	// rebooted.
+	Exclusion = Kind("exclusion")
+
+	// Precondition criteria must return at least one sample, otherwise no
+	// machine is rebooted. They are used to verify that the data the other
+	// criteria rely on is complete.
+	Precondition = Kind("precondition")
+)
+
+// Criterion is a named PromQL query used to decide whether a machine should
+// be rebooted. The query is a text/template rendered with the fields of
+// QueryParams, e.g. "probe_success[{{.Minutes}}m]".
+//
+// Inclusion queries must return samples having a "machine" and a "site"
+// label. Exclusion queries must return samples having the label named in On,
+// which is either "machine" or "site". Precondition queries can return
+// samples with any label.
+type Criterion struct {
+	Name     string `json:"name"`
+	Kind     Kind   `json:"kind"`
+	Query    string `json:"query"`
+	On       string `json:"on,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+// QueryParams holds the values available to a Criterion's query template.
+// MinSamples is the minimum number of samples a time series must have in
+// the last Minutes for its data to be considered complete.
+type QueryParams struct {
+	Minutes    int
+	MinSamples int
+}
+
+// Config is the list of criteria used by GetOfflineNodes.
+//
+// MinSamples is the number of samples per time series, over the check
+// interval, below which data is considered sparse. If zero, it defaults to
+// the number of minutes in the interval minus one, i.e. at most one missed
+// scrape with the default 1m scrape interval.
+//
+// QueryTimeout is the deadline of each query. It's not read from the
+// configuration file. If zero, queries only end with the caller's context.
+type Config struct {
+	Criteria     []Criterion   `json:"criteria"`
+	MinSamples   int           `json:"min_samples,omitempty"`
+	Activity     ActivityGuard `json:"activity"`
+	QueryTimeout time.Duration `json:"-"`
+}
+
+// ActivityGuard defers the reboot of machines where measurements are still
+// in progress, i.e. where the per-second rate of Metric over the check
+// interval is above Threshold.
+type ActivityGuard struct {
+	Metric    string  `json:"metric"`
+	Threshold float64 `json:"threshold"`
+	Disabled  bool    `json:"disabled,omitempty"`
+}
+
+// DefaultQueryTimeout is the default deadline of each query.
+const DefaultQueryTimeout = time.Minute
+
+// DefaultActivityThreshold is the default rate of the activity metric, per
+// second, above which measurements are considered in progress: about one
+// new measurement every 100 seconds. A few stray tests on a machine that is
+// otherwise offline do not defer its reboot.
+const DefaultActivityThreshold = 0.01
+
+// ActivityCriterion is the name of the exclusion applied by the
+// ActivityGuard.
+const ActivityCriterion = "measurements-in-progress"
+
+// DefaultActivityGuard returns an ActivityGuard checking for NDT tests
+// creating new snaplog files.
+func DefaultActivityGuard() ActivityGuard {
+	return ActivityGuard{
+		Metric:    `inotify_extension_create_total{ext=".s2c_snaplog"}`,
+		Threshold: DefaultActivityThreshold,
+	}
+}
+
+// Criterion returns the exclusion criterion corresponding to the guard.
+func (g ActivityGuard) Criterion() Criterion {
+	return Criterion{
+		Name: ActivityCriterion,
+		Kind: Exclusion,
+		Query: fmt.Sprintf("sum by(machine) (rate(%s[{{.Minutes}}m])) > %g",
+			g.Metric, g.Threshold),
+		On:       "machine",
+		Disabled: g.Disabled,
+	}
+}
+
+// DefaultCriteria returns the built-in criteria. A machine is to be rebooted
+// if it's unreachable via SSH or it's taking too long to boot, unless it's in
+// GMX, lame-duck or its whole site is currently offline.
+func DefaultCriteria() []Criterion {
+	return []Criterion{
+		{
+			// Machine booted > 15m ago but hasn't reported success yet.
+			// The label_replace is needed because the epoxy_* metrics lack
+			// "site".
+			Name: "epoxy-boot-stuck",
+			Kind: Inclusion,
+			Query: `label_replace(
+		epoxy_last_boot < time() - 900 and epoxy_last_success < epoxy_last_boot
+		, "site", "$1", "machine", "mlab[1-4]-([a-z]{3}[0-9t]{2}).+")`,
+		},
+		{
+			// Machine has been unreachable over SSH for the past N minutes
+			// and is not currently booting.
+			Name: "ssh-down",
+			Kind: Inclusion,
+			Query: `sum_over_time(probe_success{service="ssh", module="ssh_v4_online"}[{{.Minutes}}m]) == 0
+		unless on(machine) epoxy_last_boot > time() - 900`,
+		},
+		{
+			Name:  "gmx-machine",
+			Kind:  Exclusion,
+			Query: `gmx_machine_maintenance == 1`,
+			On:    "machine",
+		},
+		{
+			Name:  "lame-duck",
+			Kind:  Exclusion,
+			Query: `kube_node_spec_taint{key="lame-duck"} == 1`,
+			On:    "machine",
+		},
+		{
+			Name:  "gmx-site",
+			Kind:  Exclusion,
+			Query: `gmx_site_maintenance == 1`,
+			On:    "site",
+		},
+		{
+			Name:  "switch-down",
+			Kind:  Exclusion,
+			Query: `sum_over_time(probe_success{instance=~"s1.*", module="icmp"}[{{.Minutes}}m]) == 0`,
+			On:    "site",
+		},
+		{
+			// Exclude machines whose SSH probe has missing samples, so that
+			// gaps in scraping do not look like outages.
+			Name:  "sparse-data",
+			Kind:  Exclusion,
+			Query: `count_over_time(probe_success{service="ssh", module="ssh_v4_online"}[{{.Minutes}}m]) < {{.MinSamples}}`,
+			On:    "machine",
+		},
+		{
+			// The blackbox exporter must have been scraped regularly
+			// (i.e. Prometheus was actually up) for the whole interval.
+			Name: "blackbox-data-complete",
+			Kind: Precondition,
+			Query: `sum(count_over_time(up{job="blackbox-targets"}[{{.Minutes}}m]))
+		/ count(up{job="blackbox-targets"}) >= {{.MinSamples}}`,
+		},
+	}
+}
+
+// DefaultConfig returns a Config containing the default criteria.
+func DefaultConfig() *Config {
+	return &Config{
+		Criteria:     DefaultCriteria(),
+		Activity:     DefaultActivityGuard(),
+		QueryTimeout: DefaultQueryTimeout,
+	}
+}
+
+// LoadConfig reads a JSON configuration file and merges it with the default
+// criteria. A criterion having the same name as a default one replaces it,
+// inheriting any field left empty (so that, e.g., a default criterion can be
+// disabled by name only). Any other criterion is appended to the list.
+// The activity guard's fields, if present, replace the default ones.
+func LoadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fileConfig := Config{
+		Activity: DefaultActivityGuard(),
+	}
+	err = json.Unmarshal(content, &fileConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	config := DefaultConfig()
+	config.MinSamples = fileConfig.MinSamples
+	config.Activity = fileConfig.Activity
+	for _, c := range fileConfig.Criteria {
+		config.merge(c)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// merge replaces the criterion having the same name as c, or appends c to
+// the list if there is none.
+func (cfg *Config) merge(c Criterion) {
+	for i, existing := range cfg.Criteria {
+		if existing.Name != c.Name {
+			continue
+		}
+		if c.Kind == "" {
+			c.Kind = existing.Kind
+		}
+		if c.Query == "" {
+			c.Query = existing.Query
+		}
+		if c.On == "" {
+			c.On = existing.On
+		}
+		cfg.Criteria[i] = c
+		return
+	}
+	cfg.Criteria = append(cfg.Criteria, c)
+}
+
+// Params returns the QueryParams for a check interval of the given minutes.
+func (cfg *Config) Params(minutes int) QueryParams {
+	minSamples := cfg.MinSamples
+	if minSamples == 0 {
+		minSamples = minutes - 1
+	}
+	return QueryParams{
+		Minutes:    minutes,
+		MinSamples: minSamples,
+	}
+}
+
+// Kind returns the kind of the named criterion, or an empty Kind if there
+// is no such criterion.
+func (cfg *Config) Kind(name string) Kind {
+	if name == ActivityCriterion {
+		return Exclusion
+	}
+	for _, c := range cfg.Criteria {
+		if c.Name == name {
+			return c.Kind
+		}
+	}
+	return ""
+}
+
+// Validate checks that every criterion in the Config is valid and that
+// names are unique.
+func (cfg *Config) Validate() error {
+	if cfg.MinSamples < 0 {
+		return fmt.Errorf("invalid min_samples: %d", cfg.MinSamples)
+	}
+	if !cfg.Activity.Disabled {
+		if cfg.Activity.Metric == "" {
+			return errors.New("activity guard: metric cannot be empty")
+		}
+		err := cfg.Activity.Criterion().Validate()
+		if err != nil {
+			return err
+		}
+	}
+	names := map[string]bool{ActivityCriterion: true}
+	for _, c := range cfg.Criteria {
+		err := c.Validate()
+		if err != nil {
+			return err
+		}
+		if names[c.Name] {
+			return fmt.Errorf("duplicate criterion: %s", c.Name)
+		}
+		names[c.Name] = true
+	}
+	return nil
+}
+
+// Enabled returns the enabled criteria of the given kind.
+func (cfg *Config) Enabled(kind Kind) []Criterion {
+	enabled := make([]Criterion, 0)
+	for _, c := range cfg.Criteria {
+		if c.Kind == kind && !c.Disabled {
+			enabled = append(enabled, c)
+		}
+	}
+	return enabled
+}
+
+// Validate checks that the criterion has a name, a known kind, a valid
+// query template and, for exclusions, a supported label to match on.
+func (c Criterion) Validate() error {
+	if c.Name == "" {
+		return errors.New("criterion name cannot be empty")
+	}
+	switch c.Kind {
+	case Inclusion, Precondition:
+	case Exclusion:
+		if c.On != "machine" && c.On != "site" {
+			return fmt.Errorf("criterion %s: invalid label to match on: %q",
+				c.Name, c.On)
+		}
+	default:
+		return fmt.Errorf("criterion %s: invalid kind: %q", c.Name, c.Kind)
+	}
+	if c.Query == "" {
+		return fmt.Errorf("criterion %s: query cannot be empty", c.Name)
+	}
+	_, err := c.Render(QueryParams{})
+	return err
+}
+
+// Render returns the criterion's query with the template fields replaced by
+// the values in params.
+func (c Criterion) Render(params QueryParams) (string, error) {
+	tmpl, err := template.New(c.Name).Option("missingkey=error").Parse(c.Query)
+	if err != nil {
+		return "", fmt.Errorf("criterion %s: %v", c.Name, err)
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, params)
+	if err != nil {
+		return "", fmt.Errorf("criterion %s: %v", c.Name, err)
+	}
+
+	return buf.String(), nil
+}
+
+// Evaluate runs the criterion's query and returns the resulting vector. The
+// query is cancelled when ctx is done.
+func (c Criterion) Evaluate(ctx context.Context, prom promtest.PromClient,
+	params QueryParams) (model.Vector, error) {
+	query, err := c.Render(params)
+	if err != nil {
+		return nil, err
+	}
+
+	values, warnings, err := prom.Query(ctx, query, time.Now())
+	for _, warn := range warnings {
+		log.WithField("criterion", c.Name).Warn(warn)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("criterion %s: %v", c.Name, err)
+	}
+
+	vector, ok := values.(model.Vector)
+	if !ok {
+		return nil, fmt.Errorf("criterion %s: unexpected result type: %T",
+			c.Name, values)
+	}
+
+	return vector, nil
+}
@@ -0,0 +1,200 @@
+package healthcheck
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/rebot/promtest"
+	"github.com/prometheus/common/model"
+)
+
+func writeConfig(path, content string) {
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	rtx.Must(err, "Cannot write test config file")
+}
+
+func TestLoadConfig(t *testing.T) {
+	writeConfig("criteria-valid.json", `{"criteria": [
+		{"name": "lame-duck", "disabled": true},
+		{"name": "ssh-down", "query": "probe_success[{{.Minutes}}m] == 0"},
+		{"name": "rack-down", "kind": "exclusion", "on": "site",
+		 "query": "rack_up == 0"}
+	], "activity": {"threshold": 0.5}}`)
+	writeConfig("criteria-invalid.json", `notjson`)
+	writeConfig("criteria-badkind.json",
+		`{"criteria": [{"name": "x", "kind": "other", "query": "up"}]}`)
+	defer os.Remove("criteria-valid.json")
+	defer os.Remove("criteria-invalid.json")
+	defer os.Remove("criteria-badkind.json")
+
+	t.Run("success-merge", func(t *testing.T) {
+		config, err := LoadConfig("criteria-valid.json")
+		if err != nil {
+			t.Fatalf("LoadConfig() error = %v", err)
+		}
+		if len(config.Criteria) != len(DefaultCriteria())+1 {
+			t.Errorf("LoadConfig() returned %d criteria", len(config.Criteria))
+		}
+		for _, c := range config.Criteria {
+			switch c.Name {
+			case "lame-duck":
+				if !c.Disabled || c.Query == "" || c.On != "machine" {
+					t.Errorf("LoadConfig() did not merge %v", c)
+				}
+			case "ssh-down":
+				if c.Query != "probe_success[{{.Minutes}}m] == 0" ||
+					c.Kind != Inclusion {
+					t.Errorf("LoadConfig() did not replace %v", c)
+				}
+			}
+		}
+		if len(config.Enabled(Exclusion)) != 5 {
+			t.Errorf("Enabled() = %v", config.Enabled(Exclusion))
+		}
+		if config.Activity.Threshold != 0.5 ||
+			config.Activity.Metric != DefaultActivityGuard().Metric {
+			t.Errorf("LoadConfig() did not merge the activity guard: %v",
+				config.Activity)
+		}
+	})
+
+	for _, path := range []string{"notfound.json", "criteria-invalid.json",
+		"criteria-badkind.json"} {
+		t.Run("error-"+path, func(t *testing.T) {
+			if _, err := LoadConfig(path); err == nil {
+				t.Errorf("LoadConfig() did not return an error")
+			}
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{
+			name:   "success-default",
+			config: *DefaultConfig(),
+		},
+		{
+			name: "error-activity-metric-empty",
+			config: Config{
+				Activity: ActivityGuard{Threshold: 1},
+			},
+			wantErr: true,
+		},
+		{
+			name: "success-activity-disabled",
+			config: Config{
+				Activity: ActivityGuard{Disabled: true},
+			},
+		},
+		{
+			name:    "error-negative-min-samples",
+			config:  Config{MinSamples: -1},
+			wantErr: true,
+		},
+		{
+			name: "error-duplicate",
+			config: Config{Criteria: []Criterion{
+				{Name: "a", Kind: Inclusion, Query: "up"},
+				{Name: "a", Kind: Inclusion, Query: "up"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "error-empty-name",
+			config: Config{Criteria: []Criterion{
+				{Kind: Inclusion, Query: "up"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "error-empty-query",
+			config: Config{Criteria: []Criterion{
+				{Name: "a", Kind: Inclusion},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "error-invalid-on",
+			config: Config{Criteria: []Criterion{
+				{Name: "a", Kind: Exclusion, Query: "up", On: "instance"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "error-invalid-template",
+			config: Config{Criteria: []Criterion{
+				{Name: "a", Kind: Inclusion, Query: "up[{{.Minutes}m]"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "error-unknown-field",
+			config: Config{Criteria: []Criterion{
+				{Name: "a", Kind: Inclusion, Query: "up[{{.Hours}}m]"},
+			}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCriterion_Evaluate(t *testing.T) {
+	prom := promtest.NewPrometheusMockClient()
+	prom.Register("up[15m]", model.Vector{fakeOfflineNode}, nil)
+	prom.Register("scalar(up)", &model.Scalar{}, nil)
+
+	c := Criterion{Name: "test", Kind: Inclusion, Query: "up[{{.Minutes}}m]"}
+	got, err := c.Evaluate(context.Background(), prom, QueryParams{Minutes: 15})
+	if err != nil {
+		t.Fatalf("Criterion.Evaluate() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, model.Vector{fakeOfflineNode}) {
+		t.Errorf("Criterion.Evaluate() = %v", got)
+	}
+
+	c.Query = "scalar(up)"
+	if _, err := c.Evaluate(context.Background(), prom, QueryParams{}); err == nil {
+		t.Errorf("Criterion.Evaluate() did not fail on a non-vector result")
+	}
+
+	c.Query = "notregistered"
+	if _, err := c.Evaluate(context.Background(), prom, QueryParams{}); err == nil {
+		t.Errorf("Criterion.Evaluate() did not fail on a query error")
+	}
+}
+
+func TestConfig_Params(t *testing.T) {
+	config := DefaultConfig()
+	if got := config.Params(15); got.MinSamples != 14 || got.Minutes != 15 {
+		t.Errorf("Config.Params() = %v", got)
+	}
+
+	config.MinSamples = 28
+	if got := config.Params(15); got.MinSamples != 28 {
+		t.Errorf("Config.Params() = %v", got)
+	}
+}
+
+func TestActivityGuard_Criterion(t *testing.T) {
+	g := ActivityGuard{Metric: "ndt_tests_total", Threshold: 0.5}
+	got, err := g.Criterion().Render(QueryParams{Minutes: 15})
+	want := "sum by(machine) (rate(ndt_tests_total[15m])) > 0.5"
+	if err != nil || got != want {
+		t.Errorf("ActivityGuard.Criterion() = %q, %v, want %q", got, err, want)
+	}
+}
@@ -2,67 +2,197 @@ package healthcheck
 
 import (
 	"context"
-	"fmt"
-	"time"
+	"sync"
 
 	"github.com/m-lab/rebot/node"
 	"github.com/m-lab/rebot/promtest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
 	log "github.com/sirupsen/logrus"
 )
 
-// CandidatesQuery is a Prometheus query to determine what machines need to
-// be rebooted. A machine is to be rebooted if it's unreachable via SSH or
-// it's taking too long to boot, unless it's in GMX, lame-duck or its whole
-// site is currently offline.
-var CandidatesQuery = `
-	(
-		# machine booted > 15m ago but hasn't reported success yet.
-		# The label_replace is needed because the epoxy_* metrics lack "site".
-		label_replace(
-		epoxy_last_boot < time() - 900 and epoxy_last_success < epoxy_last_boot
-		, "site", "$1", "machine", "mlab[1-4]-([a-z]{3}[0-9t]{2}).+") OR
-		# machine has been unreachable over SSH for the past 15m and is not currently booting
-		(sum_over_time(probe_success{service="ssh", module="ssh_v4_online"}[%[1]dm]) == 0
-			unless on(machine) epoxy_last_boot > time() - 900)
+var (
+	metricDeferredReboots = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rebot_deferred_reboots_total",
+			Help: "Total number of reboots deferred because measurements " +
+				"were in progress on the machine.",
+		},
+		[]string{
+			"site",
+		},
 	)
-	# Exclude machines in GMX.
-	unless on(machine) gmx_machine_maintenance == 1
-	# Exclude lame-ducked Kubernetes nodes.
-	unless on (machine) kube_node_spec_taint{key="lame-duck"} == 1
-	# Exclude nodes where the site is in GMX.
-	unless on(site) gmx_site_maintenance == 1
-	# Exclude nodes where the switch is offline.
-	unless on(site) sum_over_time(probe_success{instance=~"s1.*", module="icmp"}[%[1]dm]) == 0`
-
-// GetOfflineNodes checks for offline nodes in the last N minutes.
-// It returns a Vector of samples.
-func GetOfflineNodes(prom promtest.PromClient, minutes int) ([]node.Node, error) {
-	values, warnings, err := prom.Query(context.Background(), fmt.Sprintf(CandidatesQuery, minutes), time.Now())
-	if warnings != nil {
-		for warn := range warnings {
-			log.Warn(warn)
+
+	// Nodes whose reboot was deferred during the last check, so that each
+	// deferral is counted once rather than on every check.
+	deferredMu sync.Mutex
+	deferred   = map[string]bool{}
+)
+
+// GetOfflineNodes checks for offline nodes in the last N minutes, according
+// to the criteria in config. It returns a Verdict for every node matching at
+// least one inclusion criterion, listing the inclusion criteria that matched
+// and the exclusion criteria that apply to it. A failed precondition applies
+// to every node. Only verdicts without exclusions should be considered for
+// reboot.
+//
+// The preconditions are evaluated even if no node is offline, and complete
+// is true only if all of them are met: otherwise, the nodes without a
+// verdict may be missing from the data rather than online.
+//
+// Each query is cancelled after config.QueryTimeout or when ctx is done.
+func GetOfflineNodes(ctx context.Context, prom promtest.PromClient, config *Config,
+	minutes int) (verdicts []node.Verdict, complete bool, err error) {
+	params := config.Params(minutes)
+
+	// Collect the nodes matching any of the inclusion criteria, preserving
+	// the order in which they are found.
+	verdicts = make([]node.Verdict, 0)
+	index := map[string]int{}
+	for _, c := range config.Enabled(Inclusion) {
+		values, err := evaluate(ctx, prom, config, c, params)
+		if err != nil {
+			return nil, false, err
+		}
+
+		for _, sample := range values {
+			machine := string(sample.Metric["machine"])
+			if machine == "" {
+				continue
+			}
+			i, ok := index[machine]
+			if !ok {
+				i = len(verdicts)
+				index[machine] = i
+				verdicts = append(verdicts, node.Verdict{
+					Node:   node.New(machine, string(sample.Metric["site"])),
+					Labels: map[string]string{},
+				})
+			}
+			verdicts[i].Reasons = appendUnique(verdicts[i].Reasons, c.Name)
+			for k, v := range sample.Metric {
+				if _, ok := verdicts[i].Labels[string(k)]; !ok {
+					verdicts[i].Labels[string(k)] = string(v)
+				}
+			}
 		}
 	}
-	if err != nil {
-		return nil, err
+
+	// Check that the data used by the other criteria is complete. If it
+	// isn't, no node can be trusted to be offline, nor online.
+	complete = true
+	for _, c := range config.Enabled(Precondition) {
+		values, err := evaluate(ctx, prom, config, c, params)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if len(values) == 0 {
+			log.WithField("criterion", c.Name).Warn("Precondition not met, no node will be rebooted.")
+			complete = false
+			for i := range verdicts {
+				verdicts[i].Exclusions = append(verdicts[i].Exclusions, c.Name)
+			}
+		}
+	}
+
+	if len(verdicts) == 0 {
+		return verdicts, complete, nil
+	}
+
+	// Apply the exclusion criteria to the nodes found.
+	for _, c := range config.Enabled(Exclusion) {
+		err := applyExclusion(ctx, prom, config, c, params, verdicts)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	// Defer the reboot of nodes where measurements are in progress. Only
+	// nodes that would have been rebooted otherwise count as deferred.
+	if !config.Activity.Disabled {
+		excluded := make([]bool, len(verdicts))
+		for i, v := range verdicts {
+			excluded[i] = v.Excluded()
+		}
+
+		err := applyExclusion(ctx, prom, config, config.Activity.Criterion(),
+			params, verdicts)
+		if err != nil {
+			return nil, false, err
+		}
+
+		deferredMu.Lock()
+		previous := deferred
+		deferred = map[string]bool{}
+		for i, v := range verdicts {
+			if !excluded[i] && v.Excluded() {
+				log.WithField("node", v.Name).Info("Measurements in progress, deferring reboot.")
+				if !previous[v.Name] {
+					metricDeferredReboots.WithLabelValues(v.Site).Inc()
+				}
+				deferred[v.Name] = true
+			}
+		}
+		deferredMu.Unlock()
 	}
 
-	if len(values.(model.Vector)) != 0 {
-		log.WithFields(log.Fields{"nodes": values}).Warn("Offline nodes found.")
+	for _, v := range verdicts {
+		log.WithFields(log.Fields{
+			"node":       v.Name,
+			"reasons":    v.Reasons,
+			"exclusions": v.Exclusions,
+		}).Info("Offline node found.")
 	}
 
-	candidates := make([]node.Node, 0)
+	return verdicts, complete, nil
+}
+
+// evaluate runs the criterion's query with the config's query timeout.
+func evaluate(ctx context.Context, prom promtest.PromClient, config *Config,
+	c Criterion, params QueryParams) (model.Vector, error) {
+	if config.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.QueryTimeout)
+		defer cancel()
+	}
+	return c.Evaluate(ctx, prom, params)
+}
 
-	for _, sample := range values.(model.Vector) {
-		site := sample.Metric["site"]
-		machine := sample.Metric["machine"]
-		log.Info("adding " + string(machine))
-		candidates = append(candidates, node.Node{
-			Name: string(machine),
-			Site: string(site),
-		})
+// applyExclusion evaluates the exclusion criterion c and adds it to the
+// verdicts it applies to.
+func applyExclusion(ctx context.Context, prom promtest.PromClient, config *Config,
+	c Criterion, params QueryParams, verdicts []node.Verdict) error {
+	values, err := evaluate(ctx, prom, config, c, params)
+	if err != nil {
+		return err
 	}
 
-	return candidates, nil
+	matches := map[model.LabelValue]bool{}
+	for _, sample := range values {
+		matches[sample.Metric[model.LabelName(c.On)]] = true
+	}
+
+	for i, v := range verdicts {
+		value := v.Name
+		if c.On == "site" {
+			value = v.Site
+		}
+		if matches[model.LabelValue(value)] {
+			verdicts[i].Exclusions = append(verdicts[i].Exclusions, c.Name)
+		}
+	}
+
+	return nil
+}
+
+// appendUnique appends s to slice unless it's already present.
+func appendUnique(slice []string, s string) []string {
+	for _, existing := range slice {
+		if existing == s {
+			return slice
+		}
+	}
+	return append(slice, s)
 }
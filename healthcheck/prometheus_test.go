@@ -1,13 +1,18 @@
 package healthcheck
 
 import (
-	"fmt"
+	"context"
+	"math"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	promlint "github.com/m-lab/go/prometheusx/promtest"
 	"github.com/m-lab/rebot/node"
 	"github.com/m-lab/rebot/promtest"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/model"
 )
 
@@ -16,12 +21,37 @@ var (
 	fakePromErr       *promtest.PrometheusMockClient
 	fakeOfflineSwitch *model.Sample
 	fakeOfflineNode   *model.Sample
+	fakeBootingNode   *model.Sample
+	fakeExcludedNode  *model.Sample
+	fakeGMXNode       *model.Sample
 
 	offlineNodes model.Vector
 
 	testMins = 15
 )
 
+// registerCriteria registers a response for every criterion in config. The
+// response is taken from results, if present, or is an empty vector (a
+// single sample for preconditions).
+func registerCriteria(prom *promtest.PrometheusMockClient, config *Config,
+	results map[string]model.Vector) {
+	criteria := append(config.Criteria, config.Activity.Criterion())
+	for _, c := range criteria {
+		query, err := c.Render(config.Params(testMins))
+		if err != nil {
+			panic(err)
+		}
+		v, ok := results[c.Name]
+		if !ok {
+			v = model.Vector{}
+			if c.Kind == Precondition {
+				v = model.Vector{promtest.CreateSample(nil, 15, 0)}
+			}
+		}
+		prom.Register(query, v, nil)
+	}
+}
+
 func init() {
 	fakeProm = promtest.NewPrometheusMockClient()
 	// This client does not have any registered query, thus it always
@@ -31,10 +61,10 @@ func init() {
 	now := model.Time(time.Now().Unix())
 
 	fakeOfflineSwitch = promtest.CreateSample(map[string]string{
-		"instance": "s1.iad0t.measurement-lab.org",
+		"instance": "s1.iad1t.measurement-lab.org",
 		"job":      "blackbox-targets",
 		"module":   "icmp",
-		"site":     "iad0t",
+		"site":     "iad1t",
 	}, 0, now)
 
 	fakeOfflineNode = promtest.CreateSample(map[string]string{
@@ -46,46 +76,305 @@ func init() {
 		"site":     "iad0t",
 	}, 0, now)
 
+	fakeBootingNode = promtest.CreateSample(map[string]string{
+		"machine": "mlab2.iad0t.measurement-lab.org",
+		"site":    "iad0t",
+	}, 0, now)
+
+	fakeExcludedNode = promtest.CreateSample(map[string]string{
+		"machine": "mlab1.iad1t.measurement-lab.org",
+		"site":    "iad1t",
+	}, 0, now)
+
+	fakeGMXNode = promtest.CreateSample(map[string]string{
+		"machine": "mlab3.iad0t.measurement-lab.org",
+		"site":    "iad0t",
+	}, 1, now)
+
 	offlineNodes = model.Vector{
 		fakeOfflineNode,
+		fakeExcludedNode,
+		fakeGMXNode,
 	}
 
-	fakeProm.Register(fmt.Sprintf(CandidatesQuery, testMins), offlineNodes, nil)
+	registerCriteria(fakeProm, DefaultConfig(), map[string]model.Vector{
+		"ssh-down":         offlineNodes,
+		"epoxy-boot-stuck": {fakeBootingNode, fakeOfflineNode},
+		"gmx-machine":      {fakeGMXNode},
+		"switch-down":      {fakeOfflineSwitch},
+	})
+}
+
+// withoutLabels removes the labels from the verdicts, so that they can be
+// compared without listing every label of the samples.
+func withoutLabels(verdicts []node.Verdict) []node.Verdict {
+	for i := range verdicts {
+		verdicts[i].Labels = nil
+	}
+	return verdicts
 }
 
 func Test_GetOfflineNodes(t *testing.T) {
 	tests := []struct {
 		name    string
 		prom    promtest.PromClient
+		config  *Config
 		minutes int
-		want    []node.Node
+		want    []node.Verdict
 		wantErr bool
 	}{
 		{
 			name:    "success",
 			prom:    fakeProm,
+			config:  DefaultConfig(),
 			minutes: testMins,
-			want: []node.Node{
-				node.New("mlab1.iad0t.measurement-lab.org", "iad0t"),
+			want: []node.Verdict{
+				{
+					Node:    node.New("mlab2.iad0t.measurement-lab.org", "iad0t"),
+					Reasons: []string{"epoxy-boot-stuck"},
+				},
+				{
+					Node:    node.New("mlab1.iad0t.measurement-lab.org", "iad0t"),
+					Reasons: []string{"epoxy-boot-stuck", "ssh-down"},
+				},
+				{
+					Node:       node.New("mlab1.iad1t.measurement-lab.org", "iad1t"),
+					Reasons:    []string{"ssh-down"},
+					Exclusions: []string{"switch-down"},
+				},
+				{
+					Node:       node.New("mlab3.iad0t.measurement-lab.org", "iad0t"),
+					Reasons:    []string{"ssh-down"},
+					Exclusions: []string{"gmx-machine"},
+				},
+			},
+		},
+		{
+			name: "success-criteria-disabled",
+			prom: fakeProm,
+			config: &Config{
+				Criteria: []Criterion{
+					{Name: "ssh-down", Kind: Inclusion, Disabled: true,
+						Query: DefaultCriteria()[1].Query},
+				},
 			},
+			minutes: testMins,
+			want:    []node.Verdict{},
 		},
 		{
 			name:    "error",
 			prom:    fakePromErr,
+			config:  DefaultConfig(),
 			minutes: testMins,
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := GetOfflineNodes(tt.prom, tt.minutes)
+			got, _, err := GetOfflineNodes(context.Background(), tt.prom, tt.config, tt.minutes)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("GetOfflineNodes() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !reflect.DeepEqual(got, tt.want) {
+			if !reflect.DeepEqual(withoutLabels(got), tt.want) {
+				t.Errorf("GetOfflineNodes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_GetOfflineNodes_labels(t *testing.T) {
+	got, _, err := GetOfflineNodes(context.Background(), fakeProm, DefaultConfig(), testMins)
+	if err != nil {
+		t.Fatalf("GetOfflineNodes() error = %v", err)
+	}
+	for _, v := range got {
+		if v.Name == "mlab1.iad0t.measurement-lab.org" &&
+			v.Labels["module"] != "ssh_v4_online" {
+			t.Errorf("GetOfflineNodes() labels = %v, want the sample's labels",
+				v.Labels)
+		}
+		if v.Labels["machine"] != v.Name || v.Labels["site"] != v.Site {
+			t.Errorf("GetOfflineNodes() labels = %v, want machine and site",
+				v.Labels)
+		}
+	}
+}
+
+// slowProm is a PromClient that never answers before the context is done.
+type slowProm struct{}
+
+func (slowProm) Query(ctx context.Context, q string, t time.Time) (model.Value, v1.Warnings, error) {
+	<-ctx.Done()
+	return nil, nil, ctx.Err()
+}
+
+func Test_GetOfflineNodes_timeout(t *testing.T) {
+	config := DefaultConfig()
+	config.QueryTimeout = 10 * time.Millisecond
+	_, _, err := GetOfflineNodes(context.Background(), slowProm{}, config, testMins)
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("GetOfflineNodes() error = %v, want the query timeout", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	config.QueryTimeout = 0
+	_, _, err = GetOfflineNodes(ctx, slowProm{}, config, testMins)
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("GetOfflineNodes() error = %v, want the context's error", err)
+	}
+}
+
+func Test_GetOfflineNodes_exclusionError(t *testing.T) {
+	prom := promtest.NewPrometheusMockClient()
+	registerCriteria(prom, DefaultConfig(), map[string]model.Vector{
+		"ssh-down": offlineNodes,
+	})
+	query, _ := DefaultCriteria()[5].Render(DefaultConfig().Params(testMins))
+	prom.Unregister(query)
+
+	_, _, err := GetOfflineNodes(context.Background(), prom, DefaultConfig(), testMins)
+	if err == nil {
+		t.Errorf("GetOfflineNodes() did not return an error.")
+	}
+}
+
+func Test_GetOfflineNodes_dataCompleteness(t *testing.T) {
+	sparse := promtest.NewPrometheusMockClient()
+	registerCriteria(sparse, DefaultConfig(), map[string]model.Vector{
+		"ssh-down":    {fakeOfflineNode, fakeExcludedNode},
+		"sparse-data": {fakeExcludedNode},
+	})
+
+	incomplete := promtest.NewPrometheusMockClient()
+	registerCriteria(incomplete, DefaultConfig(), map[string]model.Vector{
+		"ssh-down":               {fakeOfflineNode},
+		"blackbox-data-complete": {},
+	})
+
+	// A data gap can also hide every offline node.
+	empty := promtest.NewPrometheusMockClient()
+	registerCriteria(empty, DefaultConfig(), map[string]model.Vector{
+		"blackbox-data-complete": {},
+	})
+
+	tests := []struct {
+		name         string
+		prom         promtest.PromClient
+		want         []node.Verdict
+		wantComplete bool
+	}{
+		{
+			name:         "sparse-machine",
+			prom:         sparse,
+			wantComplete: true,
+			want: []node.Verdict{
+				{
+					Node:    node.New("mlab1.iad0t.measurement-lab.org", "iad0t"),
+					Reasons: []string{"ssh-down"},
+				},
+				{
+					Node:       node.New("mlab1.iad1t.measurement-lab.org", "iad1t"),
+					Reasons:    []string{"ssh-down"},
+					Exclusions: []string{"sparse-data"},
+				},
+			},
+		},
+		{
+			name: "incomplete-blackbox-job",
+			prom: incomplete,
+			want: []node.Verdict{
+				{
+					Node:       node.New("mlab1.iad0t.measurement-lab.org", "iad0t"),
+					Reasons:    []string{"ssh-down"},
+					Exclusions: []string{"blackbox-data-complete"},
+				},
+			},
+		},
+		{
+			name: "incomplete-no-offline-node",
+			prom: empty,
+			want: []node.Verdict{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, complete, err := GetOfflineNodes(context.Background(), tt.prom, DefaultConfig(), testMins)
+			if err != nil {
+				t.Fatalf("GetOfflineNodes() error = %v", err)
+			}
+			if !reflect.DeepEqual(withoutLabels(got), tt.want) {
 				t.Errorf("GetOfflineNodes() = %v, want %v", got, tt.want)
 			}
+			if complete != tt.wantComplete {
+				t.Errorf("GetOfflineNodes() complete = %v, want %v", complete,
+					tt.wantComplete)
+			}
 		})
 	}
 }
+
+func Test_GetOfflineNodes_activityGuard(t *testing.T) {
+	busy := promtest.NewPrometheusMockClient()
+	registerCriteria(busy, DefaultConfig(), map[string]model.Vector{
+		"ssh-down":        {fakeOfflineNode, fakeExcludedNode},
+		"switch-down":     {fakeOfflineSwitch},
+		ActivityCriterion: {fakeOfflineNode, fakeExcludedNode},
+	})
+
+	before := testutil.ToFloat64(metricDeferredReboots.WithLabelValues("iad0t"))
+
+	got, _, err := GetOfflineNodes(context.Background(), busy, DefaultConfig(), testMins)
+	if err != nil {
+		t.Fatalf("GetOfflineNodes() error = %v", err)
+	}
+	want := []node.Verdict{
+		{
+			Node:       node.New("mlab1.iad0t.measurement-lab.org", "iad0t"),
+			Reasons:    []string{"ssh-down"},
+			Exclusions: []string{ActivityCriterion},
+		},
+		{
+			Node:       node.New("mlab1.iad1t.measurement-lab.org", "iad1t"),
+			Reasons:    []string{"ssh-down"},
+			Exclusions: []string{"switch-down", ActivityCriterion},
+		},
+	}
+	if !reflect.DeepEqual(withoutLabels(got), want) {
+		t.Errorf("GetOfflineNodes() = %v, want %v", got, want)
+	}
+
+	after := testutil.ToFloat64(metricDeferredReboots.WithLabelValues("iad0t"))
+	if math.Abs(after-before-1) > 1e-9 {
+		t.Errorf("deferred reboots for iad0t = %v, want %v", after, before+1)
+	}
+	if testutil.ToFloat64(metricDeferredReboots.WithLabelValues("iad1t")) != 0 {
+		t.Errorf("an excluded node was counted as deferred")
+	}
+
+	// A node still busy on the next check is not counted again.
+	_, _, err = GetOfflineNodes(context.Background(), busy, DefaultConfig(), testMins)
+	if err != nil {
+		t.Fatalf("GetOfflineNodes() error = %v", err)
+	}
+	if got := testutil.ToFloat64(metricDeferredReboots.WithLabelValues("iad0t")); got != after {
+		t.Errorf("deferred reboots for iad0t = %v after a second check, want %v", got, after)
+	}
+
+	// When the guard is disabled, the query is not even sent.
+	config := DefaultConfig()
+	config.Activity.Disabled = true
+	query, _ := config.Activity.Criterion().Render(config.Params(testMins))
+	restore := busy.Unregister(query)
+	defer restore()
+	got, _, err = GetOfflineNodes(context.Background(), busy, config, testMins)
+	if err != nil || len(node.Candidates(got)) != 1 {
+		t.Errorf("GetOfflineNodes() = %v, %v", got, err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metricDeferredReboots.WithLabelValues("x")
+	promlint.LintMetrics(t)
+}
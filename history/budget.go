@@ -0,0 +1,147 @@
+package history
+
+import (
+	"sort"
+	"time"
+
+	"github.com/m-lab/rebot/node"
+)
+
+// Limit identifies one of the limits of a Budget.
+type Limit string
+
+const (
+	// LimitRun is the limit on the number of reboots in a single run.
+	LimitRun = Limit("run")
+
+	// LimitSite is the limit on the number of reboots per site in a single
+	// run.
+	LimitSite = Limit("site")
+
+	// LimitMetro is the limit on the number of reboots per metro in a
+	// single run.
+	LimitMetro = Limit("metro")
+
+	// LimitWindow is the limit on the number of reboots in the rolling
+	// time window.
+	LimitWindow = Limit("window")
+
+	// LimitSequence is the limit on the number of nodes per site that are
+	// rebooting at the same time.
+	LimitSequence = Limit("sequence")
+)
+
+// Budget limits how many nodes can be rebooted: at most PerRun nodes in a
+// single run, of which at most PerSite in the same site and PerMetro in the
+// same metro, and at most PerWindow nodes over the last Window. A zero or
+// negative limit disables it.
+//
+// Reboots in the window are counted from the history, i.e. a node rebooted
+// more than once in the window counts once.
+//
+// Reboots are also sequenced within each site: at most Concurrent nodes of
+// a site can be rebooting at the same time. A node is rebooting from its
+// last reboot until it's observed online, or for at most RecoveryTimeout.
+type Budget struct {
+	PerRun    int
+	PerSite   int
+	PerMetro  int
+	PerWindow int
+	Window    time.Duration
+
+	Concurrent      int
+	RecoveryTimeout time.Duration
+}
+
+// DefaultBudget returns a Budget allowing at most 5 reboots per run, and
+// one node per site rebooting at a time for up to an hour.
+func DefaultBudget() Budget {
+	return Budget{
+		PerRun:          5,
+		Window:          time.Hour,
+		Concurrent:      1,
+		RecoveryTimeout: time.Hour,
+	}
+}
+
+// Allocate returns the candidates that fit in the budget at time now, in
+// priority order, and the limit that was reached for each of the others.
+//
+// Candidates with the fewest consecutive reboot attempts come first, so that
+// nodes that were never rebooted are not starved by those that do not
+// recover, then the ones matched by the most criteria.
+func (b Budget) Allocate(candidates []node.Verdict, history map[string]node.History,
+	now time.Time) ([]node.Verdict, map[string]Limit) {
+	sorted := append([]node.Verdict{}, candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ai, aj := attempts(sorted[i], history), attempts(sorted[j], history)
+		if ai != aj {
+			return ai < aj
+		}
+		return len(sorted[i].Reasons) > len(sorted[j].Reasons)
+	})
+
+	window := 0
+	if b.PerWindow > 0 {
+		for _, h := range history {
+			if !h.LastReboot.IsZero() && now.Sub(h.LastReboot) < b.Window {
+				window++
+			}
+		}
+	}
+
+	rebooting := map[string]int{}
+	if b.Concurrent > 0 {
+		for _, h := range history {
+			if b.Rebooting(h, now) {
+				rebooting[h.Site]++
+			}
+		}
+	}
+
+	allowed := make([]node.Verdict, 0, len(sorted))
+	over := map[string]Limit{}
+	sites := map[string]int{}
+	metros := map[string]int{}
+	for _, v := range sorted {
+		switch {
+		case b.PerRun > 0 && len(allowed) >= b.PerRun:
+			over[v.Name] = LimitRun
+		case b.PerWindow > 0 && window >= b.PerWindow:
+			over[v.Name] = LimitWindow
+		case b.PerSite > 0 && sites[v.Site] >= b.PerSite:
+			over[v.Name] = LimitSite
+		case b.PerMetro > 0 && metros[v.Metro()] >= b.PerMetro:
+			over[v.Name] = LimitMetro
+		case b.Concurrent > 0 && rebooting[v.Site] >= b.Concurrent:
+			over[v.Name] = LimitSequence
+		default:
+			allowed = append(allowed, v)
+			rebooting[v.Site]++
+			sites[v.Site]++
+			metros[v.Metro()]++
+			window++
+		}
+	}
+
+	return allowed, over
+}
+
+// Rebooting returns true if the node described by h was rebooted less than
+// RecoveryTimeout before now and has not been observed online since.
+func (b Budget) Rebooting(h node.History, now time.Time) bool {
+	if h.Status != node.NotObserved && h.Status != node.ObservedOffline {
+		return false
+	}
+	return !h.LastReboot.IsZero() && now.Sub(h.LastReboot) < b.RecoveryTimeout
+}
+
+// attempts returns the number of consecutive reboots of the verdict's node
+// that did not bring it back online.
+func attempts(v node.Verdict, history map[string]node.History) int {
+	h, ok := history[v.Name]
+	if !ok || h.Status == node.ObservedOnline {
+		return 0
+	}
+	return h.Attempts
+}
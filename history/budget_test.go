@@ -0,0 +1,178 @@
+package history
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/rebot/node"
+)
+
+func TestBudget_Allocate(t *testing.T) {
+	now := time.Now()
+	verdict := func(name, site string, reasons ...string) node.Verdict {
+		return node.Verdict{
+			Node:    node.New("mlab"+name+"."+site+".measurement-lab.org", site),
+			Reasons: reasons,
+		}
+	}
+	candidates := []node.Verdict{
+		verdict("1", "lga0t", "ssh-down"),
+		verdict("2", "lga0t", "ssh-down"),
+		verdict("1", "lga1t", "ssh-down"),
+		verdict("1", "iad0t", "ssh-down"),
+		verdict("2", "iad0t", "ssh-down", "epoxy-boot-stuck"),
+	}
+	history := map[string]node.History{
+		// Rebooted once already, without recovering.
+		"mlab1.lga0t.measurement-lab.org": {
+			Node:       candidates[0].Node,
+			LastReboot: now.Add(-2 * time.Hour),
+			Status:     node.ObservedOffline,
+			Attempts:   1,
+		},
+		// Rebooted recently, and recovered.
+		"mlab3.sea0t.measurement-lab.org": {
+			Node:       node.New("mlab3.sea0t.measurement-lab.org", "sea0t"),
+			LastReboot: now.Add(-10 * time.Minute),
+			Status:     node.ObservedOnline,
+			Attempts:   0,
+		},
+	}
+
+	names := func(verdicts []node.Verdict) []string {
+		n := []string{}
+		for _, v := range verdicts {
+			n = append(n, v.Name)
+		}
+		return n
+	}
+
+	tests := []struct {
+		name     string
+		budget   Budget
+		want     []string
+		wantOver map[string]Limit
+	}{
+		{
+			name:   "unlimited",
+			budget: Budget{},
+			want: []string{
+				"mlab2.iad0t.measurement-lab.org",
+				"mlab2.lga0t.measurement-lab.org",
+				"mlab1.lga1t.measurement-lab.org",
+				"mlab1.iad0t.measurement-lab.org",
+				"mlab1.lga0t.measurement-lab.org",
+			},
+			wantOver: map[string]Limit{},
+		},
+		{
+			name:   "per-run",
+			budget: Budget{PerRun: 2},
+			want: []string{
+				"mlab2.iad0t.measurement-lab.org",
+				"mlab2.lga0t.measurement-lab.org",
+			},
+			wantOver: map[string]Limit{
+				"mlab1.lga1t.measurement-lab.org": LimitRun,
+				"mlab1.iad0t.measurement-lab.org": LimitRun,
+				"mlab1.lga0t.measurement-lab.org": LimitRun,
+			},
+		},
+		{
+			name:   "per-site",
+			budget: Budget{PerSite: 1},
+			want: []string{
+				"mlab2.iad0t.measurement-lab.org",
+				"mlab2.lga0t.measurement-lab.org",
+				"mlab1.lga1t.measurement-lab.org",
+			},
+			wantOver: map[string]Limit{
+				"mlab1.iad0t.measurement-lab.org": LimitSite,
+				"mlab1.lga0t.measurement-lab.org": LimitSite,
+			},
+		},
+		{
+			name:   "per-metro",
+			budget: Budget{PerMetro: 1},
+			want: []string{
+				"mlab2.iad0t.measurement-lab.org",
+				"mlab2.lga0t.measurement-lab.org",
+			},
+			wantOver: map[string]Limit{
+				"mlab1.lga1t.measurement-lab.org": LimitMetro,
+				"mlab1.iad0t.measurement-lab.org": LimitMetro,
+				"mlab1.lga0t.measurement-lab.org": LimitMetro,
+			},
+		},
+		{
+			// One reboot in the last hour is in the history already.
+			name:   "per-window",
+			budget: Budget{PerWindow: 3, Window: time.Hour},
+			want: []string{
+				"mlab2.iad0t.measurement-lab.org",
+				"mlab2.lga0t.measurement-lab.org",
+			},
+			wantOver: map[string]Limit{
+				"mlab1.lga1t.measurement-lab.org": LimitWindow,
+				"mlab1.iad0t.measurement-lab.org": LimitWindow,
+				"mlab1.lga0t.measurement-lab.org": LimitWindow,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, over := tt.budget.Allocate(candidates, history, now)
+			if !reflect.DeepEqual(names(got), tt.want) {
+				t.Errorf("Budget.Allocate() = %v, want %v", names(got), tt.want)
+			}
+			if !reflect.DeepEqual(over, tt.wantOver) {
+				t.Errorf("Budget.Allocate() over = %v, want %v", over, tt.wantOver)
+			}
+		})
+	}
+}
+
+func TestBudget_Allocate_sequence(t *testing.T) {
+	now := time.Now()
+	candidates := []node.Verdict{
+		{Node: node.New("mlab1.lga0t.measurement-lab.org", "lga0t")},
+		{Node: node.New("mlab2.lga0t.measurement-lab.org", "lga0t")},
+		{Node: node.New("mlab1.iad0t.measurement-lab.org", "iad0t")},
+		{Node: node.New("mlab2.iad0t.measurement-lab.org", "iad0t")},
+		{Node: node.New("mlab1.sea0t.measurement-lab.org", "sea0t")},
+	}
+	history := map[string]node.History{
+		// Rebooted 10 minutes ago, not observed yet.
+		"mlab3.lga0t.measurement-lab.org": node.NewHistory(
+			"mlab3.lga0t.measurement-lab.org", "lga0t", now.Add(-10*time.Minute)),
+		// Rebooted 2 hours ago and still offline: the timeout elapsed.
+		"mlab3.iad0t.measurement-lab.org": {
+			Node:       node.New("mlab3.iad0t.measurement-lab.org", "iad0t"),
+			LastReboot: now.Add(-2 * time.Hour),
+			Status:     node.ObservedOffline,
+		},
+		// Rebooted 10 minutes ago and back online.
+		"mlab3.sea0t.measurement-lab.org": {
+			Node:       node.New("mlab3.sea0t.measurement-lab.org", "sea0t"),
+			LastReboot: now.Add(-10 * time.Minute),
+			Status:     node.ObservedOnline,
+		},
+	}
+
+	b := Budget{Concurrent: 1, RecoveryTimeout: time.Hour}
+	got, over := b.Allocate(candidates, history, now)
+
+	want := []node.Verdict{candidates[2], candidates[4]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Budget.Allocate() = %v, want %v", got, want)
+	}
+	wantOver := map[string]Limit{
+		"mlab1.lga0t.measurement-lab.org": LimitSequence,
+		"mlab2.lga0t.measurement-lab.org": LimitSequence,
+		"mlab2.iad0t.measurement-lab.org": LimitSequence,
+	}
+	if !reflect.DeepEqual(over, wantOver) {
+		t.Errorf("Budget.Allocate() over = %v, want %v", over, wantOver)
+	}
+}
@@ -0,0 +1,254 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/m-lab/rebot/node"
+	log "github.com/sirupsen/logrus"
+)
+
+// EventType is the type of an Event.
+type EventType string
+
+const (
+	// EventCandidate is recorded when a node is found offline.
+	EventCandidate = EventType("candidate")
+
+	// EventSkipped is recorded when an offline node is not rebooted. The
+	// reason is in the event's Reason field.
+	EventSkipped = EventType("skipped")
+
+	// EventRebootSent is recorded right before sending a reboot request.
+	EventRebootSent = EventType("reboot-sent")
+
+	// EventRebootSucceeded is recorded when a reboot request succeeds.
+	EventRebootSucceeded = EventType("reboot-succeeded")
+
+	// EventRebootFailed is recorded when a reboot request fails. The error
+	// is in the event's Error field.
+	EventRebootFailed = EventType("reboot-failed")
+
+	// EventRecovered is recorded when a rebooted node is observed online.
+	EventRecovered = EventType("recovered")
+
+	// EventManualReboot is recorded when an operator requests a reboot. The
+	// requester, and the skip reason if the request was forced, are in the
+	// event's Reason field.
+	EventManualReboot = EventType("manual-reboot")
+)
+
+// Event is a single entry of the event log.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    EventType `json:"type"`
+	Machine string    `json:"machine"`
+	Site    string    `json:"site"`
+	Reasons []string  `json:"reasons,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// NewEvent returns an Event of the given type for the node n, with the
+// current time.
+func NewEvent(t EventType, n node.Node) Event {
+	return Event{
+		Time:    time.Now(),
+		Type:    t,
+		Machine: n.Name,
+		Site:    n.Site,
+	}
+}
+
+// EventLog is an append-only log of events, stored as JSON lines. When the
+// file grows bigger than maxSize bytes, it's rotated: path is renamed to
+// path.1, path.1 to path.2 and so on, keeping at most maxFiles rotated
+// files.
+type EventLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu sync.Mutex
+}
+
+// NewEventLog returns an EventLog writing to path.
+func NewEventLog(path string, maxSize int64, maxFiles int) *EventLog {
+	return &EventLog{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+}
+
+// Append appends the events to the log, rotating it first if needed.
+func (l *EventLog) Append(events ...Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var content []byte
+	for _, e := range events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		content = append(content, line...)
+		content = append(content, '\n')
+	}
+
+	stat, err := os.Stat(l.path)
+	if err == nil && l.maxSize > 0 && stat.Size() > 0 &&
+		stat.Size()+int64(len(content)) > l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Read returns the events in the log matching the query.
+func (l *EventLog) Read(q Query) ([]Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return ReadEvents(l.path, q)
+}
+
+// rotate shifts the rotated files by one, dropping the oldest one, and
+// renames the current file to path.1.
+func (l *EventLog) rotate() error {
+	if l.maxFiles < 1 {
+		return os.Remove(l.path)
+	}
+
+	err := os.Remove(rotatedName(l.path, l.maxFiles))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		err = os.Rename(rotatedName(l.path, i), rotatedName(l.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Rename(l.path, rotatedName(l.path, 1))
+}
+
+// rotatedName returns the name of the i-th rotated file.
+func rotatedName(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// Query selects events from the log. Empty fields match any event.
+type Query struct {
+	Machine string
+	Site    string
+	From    time.Time
+	To      time.Time
+}
+
+// Match returns true if the event is selected by the query.
+func (q Query) Match(e Event) bool {
+	if q.Machine != "" && q.Machine != e.Machine {
+		return false
+	}
+	if q.Site != "" && q.Site != e.Site {
+		return false
+	}
+	if !q.From.IsZero() && e.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && e.Time.After(q.To) {
+		return false
+	}
+	return true
+}
+
+// ReadEvents reads the event log at path, including the rotated files, and
+// returns the events matching the query in chronological order.
+func ReadEvents(path string, q Query) ([]Event, error) {
+	// Find the oldest rotated file.
+	oldest := 0
+	for {
+		_, err := os.Stat(rotatedName(path, oldest+1))
+		if err != nil {
+			break
+		}
+		oldest++
+	}
+
+	events := make([]Event, 0)
+	for i := oldest; i >= 0; i-- {
+		name := path
+		if i > 0 {
+			name = rotatedName(path, i)
+		}
+
+		found, err := readEventFile(name, q)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, found...)
+	}
+
+	return events, nil
+}
+
+// readEventFile returns the events matching the query in a single file. A
+// missing file contains no events.
+func readEventFile(path string, q Query) ([]Event, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	events := make([]Event, 0)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		// A line may be truncated if the process died while writing it:
+		// skip it rather than making the whole log unreadable.
+		var e Event
+		err = json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			log.WithError(err).Warnf("Skipping invalid event at %s:%d.", path, line)
+			continue
+		}
+		if q.Match(e) {
+			events = append(events, e)
+		}
+	}
+
+	return events, scanner.Err()
+}
@@ -0,0 +1,134 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/rebot/node"
+)
+
+func testEvents() []Event {
+	base := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []Event{
+		NewEvent(EventCandidate, node.New("mlab1.lga03.measurement-lab.org", "lga03")),
+		NewEvent(EventRebootSent, node.New("mlab1.lga03.measurement-lab.org", "lga03")),
+		NewEvent(EventCandidate, node.New("mlab2.lga03.measurement-lab.org", "lga03")),
+		NewEvent(EventSkipped, node.New("mlab1.iad0t.measurement-lab.org", "iad0t")),
+	}
+	for i := range events {
+		events[i].Time = base.Add(time.Duration(i) * time.Hour)
+	}
+	events[3].Reason = "excluded: switch-down"
+	return events
+}
+
+func TestEventLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	rtx.Must(err, "Cannot create temporary directory")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.jsonl")
+	events := testEvents()
+
+	// Each event is about 120 bytes, so the log is rotated after every
+	// append.
+	l := NewEventLog(path, 150, 2)
+	for _, e := range events {
+		if err := l.Append(e); err != nil {
+			t.Fatalf("EventLog.Append() error = %v", err)
+		}
+	}
+	if err := l.Append(); err != nil {
+		t.Errorf("EventLog.Append() error = %v", err)
+	}
+
+	// Only the current file and two rotated ones are kept.
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("EventLog kept too many files: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		q    Query
+		want []Event
+	}{
+		{
+			name: "all",
+			want: events[1:],
+		},
+		{
+			name: "machine",
+			q:    Query{Machine: "mlab1.lga03.measurement-lab.org"},
+			want: events[1:2],
+		},
+		{
+			name: "site",
+			q:    Query{Site: "lga03"},
+			want: events[1:3],
+		},
+		{
+			name: "time-range",
+			q:    Query{From: events[2].Time, To: events[3].Time},
+			want: events[2:4],
+		},
+		{
+			name: "no-match",
+			q:    Query{To: events[0].Time},
+			want: []Event{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := l.Read(tt.q)
+			if err != nil {
+				t.Fatalf("EventLog.Read() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("EventLog.Read() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	rtx.Must(err, "Cannot create temporary directory")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.jsonl")
+	events := testEvents()
+
+	t.Run("success-not-existing", func(t *testing.T) {
+		got, err := ReadEvents(path, Query{})
+		if err != nil || len(got) != 0 {
+			t.Errorf("ReadEvents() = %v, %v", got, err)
+		}
+	})
+
+	t.Run("success-truncated-line", func(t *testing.T) {
+		l := NewEventLog(path, 0, 0)
+		rtx.Must(l.Append(events[0]), "Cannot append event")
+
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		rtx.Must(err, "Cannot open the event log")
+		_, err = f.WriteString("\n{\"time\": \"2019-01\n")
+		rtx.Must(err, "Cannot write to the event log")
+		f.Close()
+
+		got, err := ReadEvents(path, Query{})
+		if err != nil || !reflect.DeepEqual(got, events[:1]) {
+			t.Errorf("ReadEvents() = %v, %v", got, err)
+		}
+	})
+
+	t.Run("failure-unreadable", func(t *testing.T) {
+		if _, err := ReadEvents(dir, Query{}); err == nil {
+			t.Errorf("ReadEvents() did not return an error")
+		}
+	})
+}
@@ -1,84 +1,345 @@
 package history
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/m-lab/rebot/node"
 
-	"github.com/m-lab/go/rtx"
 	log "github.com/sirupsen/logrus"
 )
 
-// Read reads a JSON file containing a map of
-// string -> candidate. If the file cannot be read or deserialized, it returns
-// an empty map.
-func Read(path string) map[string]node.History {
-	var candidateHistory map[string]node.History
+// Version is the version of the on-disk history format written by Write.
+//
+// Version 1 is a bare JSON object mapping node names to node.History.
+// Version 2 wraps the same map in an object carrying the version number.
+const Version = 2
+
+// envelope is the on-disk format of the history file.
+type envelope struct {
+	Version int                     `json:"version"`
+	Nodes   map[string]node.History `json:"nodes"`
+}
+
+// migrations maps a version to the function converting a file of that
+// version to the next one.
+var migrations = map[int]func([]byte) ([]byte, error){
+	1: migrateV1,
+}
+
+// CorruptError is returned by Read when the history file exists but cannot
+// be parsed. The file is left in place and a copy is saved to Backup, so
+// that it can be inspected or fixed by an operator. Known is true if a copy
+// with the same content had already been saved by a previous Read, i.e. the
+// corruption was already found before.
+type CorruptError struct {
+	Path   string
+	Backup string
+	Known  bool
+	Err    error
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("corrupted history file %s (saved to %s): %v",
+		e.Path, e.Backup, e.Err)
+}
+
+// Read reads a JSON file containing a map of string -> candidate, migrating
+// it from previous versions of the format if needed. If the file does not
+// exist, it returns an empty map. If the file cannot be parsed, it returns
+// a *CorruptError.
+func Read(path string) (map[string]node.History, error) {
 	file, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		// There is no existing candidate history file -> return empty map.
+		return make(map[string]node.History), nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
+	candidateHistory, err := parse(file)
 	if err != nil {
-		// There is no existing candidate history file -> return empty map.
-		return make(map[string]node.History)
+		// Don't save the same content again when restarting repeatedly.
+		if backup := findBackup(path, file); backup != "" {
+			return nil, &CorruptError{Path: path, Backup: backup, Known: true, Err: err}
+		}
+		backup := fmt.Sprintf("%s.corrupt.%d", path, time.Now().Unix())
+		if copyErr := ioutil.WriteFile(backup, file, 0644); copyErr != nil {
+			log.WithError(copyErr).Error("Cannot save a copy of the corrupted history file.")
+			backup = ""
+		}
+		return nil, &CorruptError{Path: path, Backup: backup, Err: err}
+	}
+
+	return candidateHistory, nil
+}
+
+// findBackup returns the path of an existing copy of the history file at
+// path with the given content, or an empty string.
+func findBackup(path string, content []byte) string {
+	backups, err := filepath.Glob(path + ".corrupt.*")
+	if err != nil {
+		return ""
+	}
+	for _, b := range backups {
+		existing, err := ioutil.ReadFile(b)
+		if err == nil && bytes.Equal(existing, content) {
+			return b
+		}
+	}
+	return ""
+}
+
+// parse decodes the content of a history file of any supported version.
+func parse(content []byte) (map[string]node.History, error) {
+	var probe map[string]json.RawMessage
+	err := json.Unmarshal(content, &probe)
+	if err != nil {
+		return nil, err
 	}
 
-	err = json.Unmarshal(file, &candidateHistory)
+	// Version 1 files have no "version" field, since node names are used
+	// as keys.
+	version := 1
+	if raw, ok := probe["version"]; ok {
+		err = json.Unmarshal(raw, &version)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if version > Version || version < 1 {
+		return nil, fmt.Errorf("unsupported history version: %d", version)
+	}
+
+	for ; version < Version; version++ {
+		log.WithField("version", version).Info("Migrating history file.")
+		content, err = migrations[version](content)
+		if err != nil {
+			return nil, err
+		}
+	}
 
+	var env envelope
+	err = json.Unmarshal(content, &env)
 	if err != nil {
-		log.Warn("Cannot unmarshal the candidates' history file - ignoring it. ", err)
-		return make(map[string]node.History)
+		return nil, err
+	}
+	if env.Nodes == nil {
+		env.Nodes = make(map[string]node.History)
 	}
 
-	return candidateHistory
+	return env.Nodes, nil
 }
 
-// Write serializes a string -> candidate map to a JSON file.
-// If the map cannot be serialized or the file cannot be written, it exits.
-func Write(path string, candidateHistory map[string]node.History) {
-	newCandidates, err := json.Marshal(candidateHistory)
-	rtx.Must(err, "Cannot marshal the candidates history!")
+// migrateV1 wraps a version 1 bare map in a version 2 envelope.
+func migrateV1(content []byte) ([]byte, error) {
+	var nodes map[string]node.History
+	err := json.Unmarshal(content, &nodes)
+	if err != nil {
+		return nil, err
+	}
 
-	err = ioutil.WriteFile(path, newCandidates, 0644)
-	rtx.Must(err, "Cannot write the candidates history's JSON file!")
+	for k, v := range nodes {
+		if v.LastAttempt.IsZero() {
+			v.LastAttempt = v.LastReboot
+		}
+		nodes[k] = v
+	}
+
+	return json.Marshal(envelope{Version: 2, Nodes: nodes})
 }
 
-// UpdateStatus updates the history according to the list of nodes to be
-// rebooted on the current run. If a node was in NotObserved status, it will be
-// updated to either ObservedOffline, if it's still in the candidates slice, or
-// ObservedOnline if it's not.
-func UpdateStatus(candidates []node.Node, history map[string]node.History) {
+// Write serializes a string -> candidate map to a JSON file. The file is
+// replaced atomically.
+func Write(path string, candidateHistory map[string]node.History) error {
+	content, err := json.Marshal(envelope{
+		Version: Version,
+		Nodes:   candidateHistory,
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeFile(path, content)
+}
+
+// writeFile replaces the file at path with content atomically: the content
+// is written and synced to a temporary file in the same directory, which is
+// then renamed to path.
+func writeFile(path string, content []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	// If anything goes wrong, do not leave the temporary file around. This
+	// is a no-op after a successful rename.
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	// Sync the directory so that the rename is persisted.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// CheckWritable verifies that a history file can be written to path, by
+// creating and removing a temporary file in the same directory.
+func CheckWritable(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// UpdateStatus updates the history according to the list of nodes found
+// offline on the current run, whether excluded or not. If a node was in
+// NotObserved or ObservedOffline status, it will be updated to either
+// ObservedOffline, if it's still in the candidates slice, or ObservedOnline
+// if it's not. Each call counts as a check for the nodes that have not been
+// observed online yet, and the recovery time is recorded for the ones that
+// are. A node whose last reboot request failed is also updated to
+// ObservedOnline once it's not in the candidates slice anymore, so that its
+// attempts are reset and its issue can be closed. It returns the nodes
+// observed online.
+func UpdateStatus(candidates []node.Node, history map[string]node.History) []node.History {
+	recovered := make([]node.History, 0)
+	offline := map[string]bool{}
 
 	for _, c := range candidates {
+		offline[c.Name] = true
 		hist, ok := history[c.Name]
 		if ok && hist.Status == node.NotObserved {
 			log.WithField("node", hist.Name).Warn("Reboot failed during the last run.")
 			hist.Status = node.ObservedOffline
+		}
+		if ok && hist.Status == node.ObservedOffline {
+			hist.Checks++
 			history[c.Name] = hist
 		}
 	}
 
-	// If there is any other "NotObserved" at this point, it is online now.
+	// If there is any other "NotObserved" or "ObservedOffline" at this
+	// point, it is online now.
 	for k, v := range history {
-		if v.Status == node.NotObserved {
-			log.WithField("node", v.Name).Info("The node was rebooted successfully during the last run.")
+		if offline[k] {
+			continue
+		}
+		if v.Status == node.NotObserved || v.Status == node.ObservedOffline {
+			log.WithFields(log.Fields{"node": v.Name, "checks": v.Checks + 1}).Info("The node is back online after the last reboot.")
+			v.Status = node.ObservedOnline
+			v.Attempts = 0
+			v.Checks++
+			v.Recovered = time.Now()
+			history[k] = v
+			recovered = append(recovered, v)
+		}
+		if v.Status == node.RebootFailed {
+			log.WithField("node", v.Name).Info("The node is back online after a failed reboot request.")
 			v.Status = node.ObservedOnline
+			v.Attempts = 0
+			v.Recovered = time.Now()
 			history[k] = v
+			recovered = append(recovered, v)
 		}
 	}
+
+	return recovered
 }
 
-// Update updates the LastReboot field for all the candidates named in
-// the nodes slice and sets the Status to NotObserved.
-// If a candidate did not previously exist, it creates a new one.
-func Update(candidates []node.Node, history map[string]node.History) {
+// Update updates the LastReboot field for all the candidates in the
+// verdicts slice, sets the Status to NotObserved and records the reasons for
+// the reboot. If a candidate did not previously exist, it creates a new one.
+// If the previous reboot did not bring the candidate back online, the number
+// of consecutive attempts is incremented. The open issue, if any, is kept
+// until the Tracker closes it.
+func Update(candidates []node.Verdict, history map[string]node.History) {
 	if len(candidates) == 0 {
 		return
 	}
 
 	log.WithFields(log.Fields{"nodes": candidates}).Info("Updating history...")
 	for _, c := range candidates {
-		history[c.Name] = node.NewHistory(c.Name, c.Site, time.Now())
+		h := node.NewHistory(c.Name, c.Site, time.Now())
+		h.Reasons = c.Reasons
+		h.Attempts = 1
+		if prev, ok := history[c.Name]; ok {
+			if prev.Status != node.ObservedOnline {
+				h.Attempts = prev.Attempts + 1
+			}
+			h.Issue = prev.Issue
+		}
+		history[c.Name] = h
 	}
 
 }
+
+// Clear removes a node from the history, so that it can be rebooted again
+// regardless of its previous reboots. It returns the removed entry, e.g. to
+// close its issue, or false if the node was not in the history.
+func Clear(name string, history map[string]node.History) (node.History, bool) {
+	hist, ok := history[name]
+	if !ok {
+		return node.History{}, false
+	}
+
+	log.WithFields(log.Fields{"node": name, "attempts": hist.Attempts}).Info("Clearing node history.")
+	delete(history, name)
+	return hist, true
+}
+
+// UpdateFailed records a failed reboot attempt for all the candidates named
+// in the errs map, setting the Status to RebootFailed and storing the error
+// message. LastReboot is left untouched, since the node was not rebooted.
+func UpdateFailed(candidates []node.Verdict, errs map[string]error, history map[string]node.History) {
+	for _, c := range candidates {
+		err, ok := errs[c.Name]
+		if !ok {
+			continue
+		}
+
+		hist, ok := history[c.Name]
+		if !ok {
+			hist = node.History{Node: c.Node}
+		}
+		hist.Status = node.RebootFailed
+		hist.Reasons = c.Reasons
+		hist.LastAttempt = time.Now()
+		hist.Error = err.Error()
+		history[c.Name] = hist
+
+		log.WithFields(log.Fields{"node": c.Name, "error": hist.Error}).Warn("Recording failed reboot attempt.")
+	}
+}
@@ -2,8 +2,10 @@ package history
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -31,14 +33,23 @@ var (
 )
 
 func setupCandidateHistory() {
-	json, err := json.Marshal(fakeHist)
+	content, err := json.Marshal(fakeHist)
 	rtx.Must(err, "Cannot marshal the candidates history!")
 
-	err = ioutil.WriteFile(testHistoryPath, json, 0644)
+	err = ioutil.WriteFile(testHistoryPath, content, 0644)
 	rtx.Must(err, "Cannot write the candidates history's JSON file!")
 
 	err = ioutil.WriteFile("invalidhistory", []byte("notjson"), 0644)
 	rtx.Must(err, "Cannot write the invalid history's JSON file!")
+
+	v2, err := json.Marshal(envelope{Version: 2, Nodes: fakeHist})
+	rtx.Must(err, "Cannot marshal the candidates history!")
+
+	err = ioutil.WriteFile("historyv2", v2, 0644)
+	rtx.Must(err, "Cannot write the candidates history's JSON file!")
+
+	err = ioutil.WriteFile("futurehistory", []byte(`{"version": 99, "nodes": {}}`), 0644)
+	rtx.Must(err, "Cannot write the future history's JSON file!")
 }
 
 func removeFiles(files ...string) {
@@ -52,32 +63,70 @@ func removeFiles(files ...string) {
 
 func Test_readCandidateHistory(t *testing.T) {
 	tests := []struct {
-		name string
-		path string
-		want map[string]node.History
+		name        string
+		path        string
+		want        map[string]node.History
+		wantCorrupt bool
 	}{
 		{
-			name: "success",
+			name: "success-v1",
 			path: testHistoryPath,
 			want: fakeHist,
 		},
+		{
+			name: "success-v2",
+			path: "historyv2",
+			want: fakeHist,
+		},
 		{
 			name: "file not existing",
 			path: "notfound",
 			want: map[string]node.History{},
 		},
 		{
-			name: "invalid history",
-			path: "invalidhistory",
-			want: map[string]node.History{},
+			name:        "invalid history",
+			path:        "invalidhistory",
+			wantCorrupt: true,
+		},
+		{
+			name:        "unsupported version",
+			path:        "futurehistory",
+			wantCorrupt: true,
 		},
 	}
 
 	setupCandidateHistory()
-	defer removeFiles(testHistoryPath, "invalidhistory")
+	defer removeFiles(testHistoryPath, "invalidhistory", "historyv2",
+		"futurehistory")
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := Read(tt.path)
+			got, err := Read(tt.path)
+			if tt.wantCorrupt {
+				corrupt, ok := err.(*CorruptError)
+				if !ok {
+					t.Fatalf("Read() error = %v, want a *CorruptError", err)
+				}
+				// The original file must be preserved and a copy saved.
+				if _, err := os.Stat(tt.path); err != nil {
+					t.Errorf("Read() removed the corrupted file: %v", err)
+				}
+				if _, err := os.Stat(corrupt.Backup); err != nil || corrupt.Known {
+					t.Errorf("Read() did not save a copy: %v, %v", corrupt, err)
+				}
+				defer removeFiles(corrupt.Backup)
+
+				// Reading the same content again reuses the copy.
+				_, err = Read(tt.path)
+				again, ok := err.(*CorruptError)
+				if !ok || again.Backup != corrupt.Backup || !again.Known {
+					t.Errorf("Read() again = %v, want the existing copy %s",
+						err, corrupt.Backup)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
 
 			// Here we use go-cmp as time.Time will not be exactly the same
 			// after marshalling/unmarshalling. In particular, the monotonic
@@ -105,9 +154,38 @@ func Test_writeCandidateHistory(t *testing.T) {
 	defer removeFiles(testHistoryPath)
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			Write(tt.path, tt.candidateHistory)
+			err := Write(tt.path, tt.candidateHistory)
+			if err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+
+			got, err := Read(tt.path)
+			if err != nil || !cmp.Equal(got, tt.candidateHistory) {
+				t.Errorf("Read() = %v, %v, want %v", got, err, tt.candidateHistory)
+			}
+
+			// No temporary file must be left behind.
+			matches, _ := filepath.Glob(tt.path + ".tmp*")
+			if len(matches) != 0 {
+				t.Errorf("Write() left temporary files: %v", matches)
+			}
 		})
 	}
+
+	t.Run("failure-dir-not-existing", func(t *testing.T) {
+		if err := Write("notfound/history", fakeHist); err == nil {
+			t.Errorf("Write() did not return an error.")
+		}
+	})
+}
+
+func TestCheckWritable(t *testing.T) {
+	if err := CheckWritable(testHistoryPath); err != nil {
+		t.Errorf("CheckWritable() error = %v", err)
+	}
+	if err := CheckWritable("notfound/history"); err == nil {
+		t.Errorf("CheckWritable() did not return an error.")
+	}
 }
 
 func cloneHistory(h map[string]node.History) map[string]node.History {
@@ -119,9 +197,15 @@ func cloneHistory(h map[string]node.History) map[string]node.History {
 	return newHistory
 }
 func Test_updateHistory(t *testing.T) {
-	nodes := []node.Node{
-		node.New("mlab1.iad0t.measurement-lab.org", "iad0t"),
-		node.New("mlab1.iad1t.measurement-lab.org", "iad1t"),
+	nodes := []node.Verdict{
+		{
+			Node:    node.New("mlab1.iad0t.measurement-lab.org", "iad0t"),
+			Reasons: []string{"ssh-down"},
+		},
+		{
+			Node:    node.New("mlab1.iad1t.measurement-lab.org", "iad1t"),
+			Reasons: []string{"epoxy-boot-stuck"},
+		},
 	}
 
 	testHistory := cloneHistory(fakeHist)
@@ -141,12 +225,16 @@ func Test_updateHistory(t *testing.T) {
 				t.Errorf("updateHistory() did not update LastReboot for node %v.", candidate.Name)
 			}
 
+			if len(candidate.Reasons) != 1 {
+				t.Errorf("updateHistory() did not update Reasons for node %v.", candidate.Name)
+			}
+
 		}
 	})
 
 	testHistory = cloneHistory(fakeHist)
 	t.Run("success-empty-nodes-slice", func(t *testing.T) {
-		Update([]node.Node{}, testHistory)
+		Update([]node.Verdict{}, testHistory)
 
 		if !cmp.Equal(testHistory, fakeHist) {
 			t.Errorf("updateHistory() = %v, want %v", testHistory, fakeHist)
@@ -154,8 +242,8 @@ func Test_updateHistory(t *testing.T) {
 
 	})
 
-	n := []node.Node{
-		node.New("mlab2.iad1t.measurement-lab.org", "iad1t"),
+	n := []node.Verdict{
+		{Node: node.New("mlab2.iad1t.measurement-lab.org", "iad1t")},
 	}
 
 	t.Run("success-new-candidate", func(t *testing.T) {
@@ -210,6 +298,69 @@ func TestUpdateStatusObservedOffline(t *testing.T) {
 	}
 }
 
+func TestUpdateStatusRecovery(t *testing.T) {
+	testHistory := map[string]node.History{
+		"mlab1.iad0t.measurement-lab.org": node.NewHistory(
+			"mlab1.iad0t.measurement-lab.org", "iad0t",
+			time.Now().Add(-time.Hour)),
+	}
+	offline := []node.Node{node.New("mlab1.iad0t.measurement-lab.org", "iad0t")}
+
+	// The node is still offline for two checks.
+	for i := 0; i < 2; i++ {
+		if got := UpdateStatus(offline, testHistory); len(got) != 0 {
+			t.Errorf("UpdateStatus() = %v, want no recovered nodes", got)
+		}
+	}
+
+	got := UpdateStatus([]node.Node{}, testHistory)
+	if len(got) != 1 {
+		t.Fatalf("UpdateStatus() = %v, want one recovered node", got)
+	}
+
+	h := testHistory["mlab1.iad0t.measurement-lab.org"]
+	if h.Status != node.ObservedOnline || h.Checks != 3 ||
+		h.RecoveryTime() < time.Hour || h.RecoveryTime() > 2*time.Hour {
+		t.Errorf("UpdateStatus() did not record the recovery: %+v", h)
+	}
+
+	// Further checks don't change the recovery time.
+	UpdateStatus([]node.Node{}, testHistory)
+	if !testHistory["mlab1.iad0t.measurement-lab.org"].Recovered.Equal(h.Recovered) {
+		t.Errorf("UpdateStatus() updated the recovery time again.")
+	}
+}
+
+func TestUpdateStatusRebootFailed(t *testing.T) {
+	hist := node.NewHistory("mlab1.iad0t.measurement-lab.org", "iad0t",
+		time.Now().Add(-48*time.Hour))
+	hist.Attempts = 2
+	hist.Issue = 7
+	testHistory := map[string]node.History{hist.Name: hist}
+	UpdateFailed([]node.Verdict{{Node: hist.Node}},
+		map[string]error{hist.Name: errors.New("timeout")}, testHistory)
+	offline := []node.Node{hist.Node}
+
+	// The node is still offline: the failure is kept so that the request is
+	// retried.
+	if got := UpdateStatus(offline, testHistory); len(got) != 0 ||
+		testHistory[hist.Name].Status != node.RebootFailed {
+		t.Errorf("UpdateStatus() = %v, want the failure kept: %+v", got,
+			testHistory[hist.Name])
+	}
+
+	got := UpdateStatus([]node.Node{}, testHistory)
+	h := testHistory[hist.Name]
+	if len(got) != 1 || h.Status != node.ObservedOnline || h.Attempts != 0 ||
+		h.Recovered.IsZero() || h.Issue != 7 {
+		t.Errorf("UpdateStatus() did not record the recovery: %v, %+v", got, h)
+	}
+	if h.RecoveryTime() != 0 {
+		t.Errorf("RecoveryTime() = %v, want 0 after a failed request",
+			h.RecoveryTime())
+	}
+}
+
 func TestUpdateStatusObservedOnline(t *testing.T) {
 	testHistory := cloneHistory(fakeHist)
 
@@ -226,3 +377,92 @@ func TestUpdateStatusObservedOnline(t *testing.T) {
 	}
 
 }
+
+func TestUpdateAttempts(t *testing.T) {
+	offline := node.NewHistory("mlab1.iad0t.measurement-lab.org", "iad0t",
+		time.Now().Add(-25*time.Hour))
+	offline.Status = node.ObservedOffline
+	offline.Attempts = 2
+	offline.Issue = 7
+
+	online := offline
+	online.Name = "mlab2.iad0t.measurement-lab.org"
+	online.Status = node.ObservedOnline
+
+	testHistory := map[string]node.History{
+		offline.Name: offline,
+		online.Name:  online,
+	}
+
+	Update([]node.Verdict{
+		{Node: offline.Node},
+		{Node: online.Node},
+		{Node: node.New("mlab3.iad0t.measurement-lab.org", "iad0t")},
+	}, testHistory)
+
+	want := map[string]int{
+		"mlab1.iad0t.measurement-lab.org": 3,
+		"mlab2.iad0t.measurement-lab.org": 1,
+		"mlab3.iad0t.measurement-lab.org": 1,
+	}
+	for name, attempts := range want {
+		if testHistory[name].Attempts != attempts {
+			t.Errorf("Update() Attempts = %d for %s, want %d",
+				testHistory[name].Attempts, name, attempts)
+		}
+	}
+	// Issues are kept until they are closed.
+	if testHistory[offline.Name].Issue != 7 || testHistory[online.Name].Issue != 7 {
+		t.Errorf("Update() did not keep the issues: %v", testHistory)
+	}
+}
+
+func TestClear(t *testing.T) {
+	testHistory := cloneHistory(fakeHist)
+
+	want := testHistory["mlab1.iad0t.measurement-lab.org"]
+	if got, ok := Clear("mlab1.iad0t.measurement-lab.org", testHistory); !ok ||
+		!cmp.Equal(got, want) {
+		t.Errorf("Clear() = %v, %v, want %v, true", got, ok, want)
+	}
+	if _, ok := testHistory["mlab1.iad0t.measurement-lab.org"]; ok {
+		t.Errorf("Clear() did not remove the node from the history.")
+	}
+	if _, ok := Clear("notfound", testHistory); ok {
+		t.Errorf("Clear() = true, want false")
+	}
+}
+
+func TestUpdateFailed(t *testing.T) {
+	testHistory := cloneHistory(fakeHist)
+	lastReboot := testHistory["mlab2.iad0t.measurement-lab.org"].LastReboot
+
+	candidates := []node.Verdict{
+		{Node: node.New("mlab2.iad0t.measurement-lab.org", "iad0t"),
+			Reasons: []string{"ssh-down"}},
+		{Node: node.New("mlab3.iad0t.measurement-lab.org", "iad0t")},
+		{Node: node.New("mlab4.iad0t.measurement-lab.org", "iad0t")},
+	}
+	errs := map[string]error{
+		"mlab2.iad0t.measurement-lab.org": errors.New("i/o error"),
+		"mlab3.iad0t.measurement-lab.org": errors.New("timeout"),
+	}
+
+	UpdateFailed(candidates, errs, testHistory)
+
+	el := testHistory["mlab2.iad0t.measurement-lab.org"]
+	if el.Status != node.RebootFailed || el.Error != "i/o error" ||
+		!el.LastReboot.Equal(lastReboot) ||
+		!el.LastAttempt.After(time.Now().Add(-1*time.Minute)) {
+		t.Errorf("UpdateFailed() did not record the failure: %v", el)
+	}
+
+	el, ok := testHistory["mlab3.iad0t.measurement-lab.org"]
+	if !ok || el.Status != node.RebootFailed || !el.LastReboot.IsZero() {
+		t.Errorf("UpdateFailed() did not add the new node: %v", el)
+	}
+
+	if _, ok := testHistory["mlab4.iad0t.measurement-lab.org"]; ok {
+		t.Errorf("UpdateFailed() added a node that did not fail.")
+	}
+}
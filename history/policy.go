@@ -0,0 +1,100 @@
+package history
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/m-lab/rebot/node"
+	log "github.com/sirupsen/logrus"
+)
+
+// Policy determines how long to wait before rebooting a node again.
+//
+// After a successful reboot request the node is not rebooted for Interval.
+// Each consecutive reboot that does not bring the node back online multiplies
+// the interval by Backoff. Once MaxAttempts consecutive reboots have failed
+// to bring the node back online, it is marked as needing human intervention
+// and it is not rebooted anymore until cleared. A failed reboot request can
+// be retried after RetryInterval.
+type Policy struct {
+	Interval      time.Duration
+	RetryInterval time.Duration
+	Backoff       float64
+	MaxAttempts   int
+}
+
+// DefaultPolicy returns a Policy waiting 24 hours between reboots, with no
+// backoff and no maximum number of attempts.
+func DefaultPolicy() Policy {
+	return Policy{
+		Interval:      24 * time.Hour,
+		RetryInterval: time.Hour,
+		Backoff:       1,
+		MaxAttempts:   0,
+	}
+}
+
+// Cooldown returns how long to wait after the last reboot of the node
+// described by h before rebooting it again.
+func (p Policy) Cooldown(h node.History) time.Duration {
+	if h.Attempts <= 1 || p.Backoff <= 1 {
+		return p.Interval
+	}
+
+	cooldown := float64(p.Interval) * math.Pow(p.Backoff, float64(h.Attempts-1))
+	if cooldown > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(cooldown)
+}
+
+// Exhausted returns true if the node described by h has been rebooted the
+// maximum number of times without coming back online.
+func (p Policy) Exhausted(h node.History) bool {
+	return p.MaxAttempts > 0 && h.Attempts >= p.MaxAttempts &&
+		h.Status == node.ObservedOffline
+}
+
+// MarkExhausted sets NeedsHuman for every node in the history that has
+// exhausted its reboot attempts, and returns the nodes that were marked
+// during this call.
+func (p Policy) MarkExhausted(history map[string]node.History) []node.History {
+	marked := make([]node.History, 0)
+	for k, v := range history {
+		if v.NeedsHuman || !p.Exhausted(v) {
+			continue
+		}
+
+		log.WithFields(log.Fields{"node": v.Name, "attempts": v.Attempts}).Error("The node did not recover after the maximum number of reboots - it needs a human.")
+		v.NeedsHuman = true
+		history[k] = v
+		marked = append(marked, v)
+	}
+	return marked
+}
+
+// SkipReason returns why the candidate cannot be rebooted according to its
+// history, or an empty string if it can be rebooted.
+func (p Policy) SkipReason(candidate node.Node, history map[string]node.History) string {
+	h, ok := history[candidate.Name]
+	if !ok {
+		// New candidate.
+		return ""
+	}
+
+	if h.NeedsHuman {
+		return fmt.Sprintf("needs a human after %d attempts", h.Attempts)
+	}
+
+	if h.Status == node.RebootFailed &&
+		time.Since(h.LastAttempt) <= p.RetryInterval {
+		return "last reboot attempt failed recently"
+	}
+
+	if !h.LastReboot.IsZero() && time.Since(h.LastReboot) <= p.Cooldown(h) {
+		return fmt.Sprintf("rebooted recently (cooldown %v)", p.Cooldown(h))
+	}
+
+	return ""
+}
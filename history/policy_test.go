@@ -0,0 +1,204 @@
+package history
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/rebot/node"
+)
+
+func TestPolicy_SkipReason(t *testing.T) {
+	p := DefaultPolicy()
+	p.Backoff = 2
+
+	h := map[string]node.History{
+		"mlab1.iad0t.measurement-lab.org": node.NewHistory(
+			"mlab1.iad0t.measurement-lab.org", "iad0t", time.Now()),
+		"mlab2.iad0t.measurement-lab.org": node.NewHistory(
+			"mlab.iad0t.measurement-lab.org", "iad0t",
+			time.Now().Add(-25*time.Hour)),
+		"mlab1.iad1t.measurement-lab.org": node.NewHistory(
+			"mlab1.iad1t.measurement-lab.org", "iad1t",
+			time.Now().Add(-23*time.Hour)),
+	}
+
+	failedRecently := node.NewHistory("mlab3.iad0t.measurement-lab.org",
+		"iad0t", time.Time{})
+	failedRecently.Status = node.RebootFailed
+	failedRecently.LastAttempt = time.Now().Add(-10 * time.Minute)
+	h[failedRecently.Name] = failedRecently
+
+	failedEarlier := failedRecently
+	failedEarlier.Name = "mlab4.iad0t.measurement-lab.org"
+	failedEarlier.LastAttempt = time.Now().Add(-2 * time.Hour)
+	h[failedEarlier.Name] = failedEarlier
+
+	// Nodes that were rebooted 25 hours ago, but had already been rebooted
+	// twice without recovering.
+	backingOff := node.NewHistory("mlab1.iad2t.measurement-lab.org", "iad2t",
+		time.Now().Add(-25*time.Hour))
+	backingOff.Attempts = 2
+	backingOff.Status = node.ObservedOffline
+	h[backingOff.Name] = backingOff
+
+	needsHuman := node.NewHistory("mlab2.iad2t.measurement-lab.org", "iad2t",
+		time.Now().Add(-72*time.Hour))
+	needsHuman.NeedsHuman = true
+	h[needsHuman.Name] = needsHuman
+
+	notRebootableBackoff := []node.Verdict{
+		{Node: node.New("mlab1.iad2t.measurement-lab.org", "iad2t")},
+		{Node: node.New("mlab2.iad2t.measurement-lab.org", "iad2t")},
+	}
+
+	// Nodes where the last reboot request failed.
+	retryable := []node.Verdict{
+		{Node: node.New("mlab4.iad0t.measurement-lab.org", "iad0t")},
+	}
+	notRetryable := []node.Verdict{
+		{Node: node.New("mlab3.iad0t.measurement-lab.org", "iad0t")},
+	}
+
+	// Nodes where no previous reboot was present
+	noHistory := []node.Verdict{
+		{Node: node.New("mlab2.iad1t.measurement-lab.org", "iad1t")},
+	}
+
+	// Nodes where LastReboot is before 24hrs ago.
+	rebootable := []node.Verdict{
+		{Node: node.New("mlab2.iad0t.measurement-lab.org", "iad0t")},
+	}
+
+	// Nodes where LastReboot is within the last 24hrs.
+	notRebootable := []node.Verdict{
+		{Node: node.New("mlab1.iad0t.measurement-lab.org", "iad0t")},
+		{Node: node.New("mlab1.iad1t.measurement-lab.org", "iad1t")},
+	}
+	tests := []struct {
+		name             string
+		candidates       []node.Verdict
+		candidateHistory map[string]node.History
+		want             []node.Verdict
+	}{
+		{
+			name:             "success-no-history",
+			candidates:       noHistory,
+			candidateHistory: h,
+			want:             noHistory,
+		},
+		{
+			name:             "success-rebootable",
+			candidates:       rebootable,
+			candidateHistory: h,
+			want:             rebootable,
+		},
+		{
+			name:             "success-retryable",
+			candidates:       retryable,
+			candidateHistory: h,
+			want:             retryable,
+		},
+		{
+			name:             "success-not-retryable",
+			candidates:       notRetryable,
+			candidateHistory: h,
+			want:             []node.Verdict{},
+		},
+		{
+			name:             "success-not-rebootable-backoff",
+			candidates:       notRebootableBackoff,
+			candidateHistory: h,
+			want:             []node.Verdict{},
+		},
+		{
+			name:             "success-not-rebootable",
+			candidates:       notRebootable,
+			candidateHistory: h,
+			want:             []node.Verdict{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []node.Verdict{}
+			for _, c := range tt.candidates {
+				if p.SkipReason(c.Node, tt.candidateHistory) == "" {
+					got = append(got, c)
+				}
+			}
+			if !(len(got) == 0 && len(tt.want) == 0) && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Policy.SkipReason() kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicy_Cooldown(t *testing.T) {
+	p := Policy{Interval: time.Hour, Backoff: 2}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 0, want: time.Hour},
+		{attempts: 1, want: time.Hour},
+		{attempts: 2, want: 2 * time.Hour},
+		{attempts: 4, want: 8 * time.Hour},
+		{attempts: 100, want: time.Duration(math.MaxInt64)},
+	}
+	for _, tt := range tests {
+		h := node.History{Attempts: tt.attempts}
+		if got := p.Cooldown(h); got != tt.want {
+			t.Errorf("Policy.Cooldown(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+
+	p.Backoff = 0
+	if got := p.Cooldown(node.History{Attempts: 3}); got != time.Hour {
+		t.Errorf("Policy.Cooldown() = %v, want %v", got, time.Hour)
+	}
+}
+
+func TestPolicy_MarkExhausted(t *testing.T) {
+	p := DefaultPolicy()
+	p.MaxAttempts = 3
+
+	exhausted := node.NewHistory("mlab1.iad0t.measurement-lab.org", "iad0t",
+		time.Now())
+	exhausted.Attempts = 3
+	exhausted.Status = node.ObservedOffline
+
+	notYet := exhausted
+	notYet.Name = "mlab2.iad0t.measurement-lab.org"
+	notYet.Attempts = 2
+
+	pending := exhausted
+	pending.Name = "mlab3.iad0t.measurement-lab.org"
+	pending.Status = node.NotObserved
+
+	h := map[string]node.History{
+		exhausted.Name: exhausted,
+		notYet.Name:    notYet,
+		pending.Name:   pending,
+	}
+
+	marked := p.MarkExhausted(h)
+	if len(marked) != 1 || marked[0].Name != exhausted.Name {
+		t.Errorf("Policy.MarkExhausted() = %v", marked)
+	}
+	if !h[exhausted.Name].NeedsHuman || h[notYet.Name].NeedsHuman ||
+		h[pending.Name].NeedsHuman {
+		t.Errorf("Policy.MarkExhausted() did not update the history: %v", h)
+	}
+
+	// Nodes already marked are not returned again.
+	if marked := p.MarkExhausted(h); len(marked) != 0 {
+		t.Errorf("Policy.MarkExhausted() = %v, want none", marked)
+	}
+
+	// A zero MaxAttempts means no limit.
+	h[notYet.Name] = notYet
+	if marked := DefaultPolicy().MarkExhausted(h); len(marked) != 0 {
+		t.Errorf("Policy.MarkExhausted() = %v, want none", marked)
+	}
+}
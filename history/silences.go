@@ -0,0 +1,246 @@
+package history
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/m-lab/rebot/node"
+	log "github.com/sirupsen/logrus"
+)
+
+// Silence prevents the automated reboot of the nodes it matches until it
+// expires. A node is matched if it matches all the non-empty fields among
+// Machine, the machine name, Site, a regular expression matching the whole
+// site name, and Labels, labels that must have the same value in the
+// node's verdict.
+type Silence struct {
+	ID      string            `json:"id"`
+	Machine string            `json:"machine,omitempty"`
+	Site    string            `json:"site,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Created time.Time         `json:"created"`
+	Expires time.Time         `json:"expires"`
+	Author  string            `json:"author"`
+	Comment string            `json:"comment"`
+
+	// site is the compiled Site regular expression.
+	site *regexp.Regexp
+}
+
+// Validate checks that the silence matches something, that its site
+// regular expression is valid, that it has not expired yet and that it has
+// an author. The site regular expression is compiled once for Match.
+func (s *Silence) Validate() error {
+	if s.Machine == "" && s.Site == "" && len(s.Labels) == 0 {
+		return errors.New("a silence must match a machine, a site or labels")
+	}
+	if s.Machine != "" {
+		if _, err := node.Parse(s.Machine); err != nil {
+			return err
+		}
+	}
+	if err := s.compile(); err != nil {
+		return err
+	}
+	if s.Expires.IsZero() {
+		return errors.New("a silence must have an expiry")
+	}
+	if !s.Active(time.Now()) {
+		return errors.New("the silence has already expired")
+	}
+	if s.Author == "" {
+		return errors.New("a silence must have an author")
+	}
+	return nil
+}
+
+// compile compiles the site regular expression, anchored to match the whole
+// site name.
+func (s *Silence) compile() error {
+	if s.Site == "" {
+		return nil
+	}
+	site, err := regexp.Compile("^(?:" + s.Site + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid site regexp: %v", err)
+	}
+	s.site = site
+	return nil
+}
+
+// Active returns true if the silence has not expired at time t.
+func (s Silence) Active(t time.Time) bool {
+	return t.Before(s.Expires)
+}
+
+// Match returns true if the silence applies to the verdict's node,
+// regardless of its expiry.
+func (s Silence) Match(v node.Verdict) bool {
+	if s.Machine != "" && s.Machine != v.Name {
+		return false
+	}
+	if s.Site != "" {
+		if s.site == nil && s.compile() != nil {
+			return false
+		}
+		if !s.site.MatchString(v.Site) {
+			return false
+		}
+	}
+	for k, value := range s.Labels {
+		if v.Labels[k] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns a description of the silence, used as a skip reason.
+func (s Silence) String() string {
+	return fmt.Sprintf("silenced by %s until %s (%s): %s", s.Author,
+		s.Expires.Format(time.RFC3339), s.ID, s.Comment)
+}
+
+// Silences is the set of silences, persisted to a JSON file. It's safe for
+// concurrent use.
+type Silences struct {
+	path     string
+	silences []Silence
+
+	mu sync.Mutex
+}
+
+// ReadSilences reads the silences stored in the JSON file at path. If the
+// file does not exist, there are no silences.
+func ReadSilences(path string) (*Silences, error) {
+	s := &Silences{
+		path:     path,
+		silences: make([]Silence, 0),
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(content, &s.silences)
+	if err != nil {
+		return nil, fmt.Errorf("corrupted silences file %s: %v", path, err)
+	}
+	for i := range s.silences {
+		if err = s.silences[i].compile(); err != nil {
+			return nil, fmt.Errorf("corrupted silences file %s: %v", path, err)
+		}
+	}
+	return s, nil
+}
+
+// List returns the silences that have not expired.
+func (s *Silences) List() []Silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	active := make([]Silence, 0, len(s.silences))
+	for _, silence := range s.silences {
+		if silence.Active(now) {
+			active = append(active, silence)
+		}
+	}
+	return active
+}
+
+// Add validates the silence, assigns it an ID and persists it, dropping
+// the expired silences. A short machine name is replaced with the fully
+// qualified one. It returns the added silence.
+func (s *Silences) Add(silence Silence) (Silence, error) {
+	err := silence.Validate()
+	if err != nil {
+		return Silence{}, err
+	}
+	if silence.Machine != "" {
+		n, _ := node.Parse(silence.Machine)
+		silence.Machine = n.Name
+	}
+
+	id := make([]byte, 8)
+	if _, err = rand.Read(id); err != nil {
+		return Silence{}, err
+	}
+	silence.ID = hex.EncodeToString(id)
+	if silence.Created.IsZero() {
+		silence.Created = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune()
+	s.silences = append(s.silences, silence)
+	log.WithFields(log.Fields{"id": silence.ID, "author": silence.Author,
+		"expires": silence.Expires}).Info("Silence added.")
+	return silence, s.write()
+}
+
+// Remove removes the silence with the given ID. It returns false if there
+// is no such silence.
+func (s *Silences) Remove(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, silence := range s.silences {
+		if silence.ID == id {
+			s.silences = append(s.silences[:i], s.silences[i+1:]...)
+			log.WithField("id", id).Info("Silence removed.")
+			return true, s.write()
+		}
+	}
+	return false, nil
+}
+
+// Match returns the first silence that has not expired and applies to the
+// verdict's node.
+func (s *Silences) Match(v node.Verdict) (Silence, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, silence := range s.silences {
+		if silence.Active(now) && silence.Match(v) {
+			return silence, true
+		}
+	}
+	return Silence{}, false
+}
+
+// prune drops the expired silences. The caller must hold s.mu.
+func (s *Silences) prune() {
+	now := time.Now()
+	active := make([]Silence, 0, len(s.silences))
+	for _, silence := range s.silences {
+		if silence.Active(now) {
+			active = append(active, silence)
+		}
+	}
+	s.silences = active
+}
+
+// write persists the silences. The caller must hold s.mu.
+func (s *Silences) write() error {
+	content, err := json.Marshal(s.silences)
+	if err != nil {
+		return err
+	}
+	return writeFile(s.path, content)
+}
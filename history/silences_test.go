@@ -0,0 +1,194 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/rebot/node"
+)
+
+func TestSilence_Match(t *testing.T) {
+	v := node.Verdict{
+		Node: node.New("mlab1.lga0t.measurement-lab.org", "lga0t"),
+		Labels: map[string]string{
+			"machine": "mlab1.lga0t.measurement-lab.org",
+			"module":  "ssh_v4_online",
+		},
+	}
+	tests := []struct {
+		name    string
+		silence Silence
+		want    bool
+	}{
+		{
+			name:    "machine",
+			silence: Silence{Machine: "mlab1.lga0t.measurement-lab.org"},
+			want:    true,
+		},
+		{
+			name:    "other-machine",
+			silence: Silence{Machine: "mlab2.lga0t.measurement-lab.org"},
+		},
+		{
+			name:    "site-regexp",
+			silence: Silence{Site: "lga.*"},
+			want:    true,
+		},
+		{
+			name:    "site-regexp-partial",
+			silence: Silence{Site: "lga"},
+		},
+		{
+			name:    "labels",
+			silence: Silence{Labels: map[string]string{"module": "ssh_v4_online"}},
+			want:    true,
+		},
+		{
+			name:    "other-labels",
+			silence: Silence{Labels: map[string]string{"module": "ssh_v6_online"}},
+		},
+		{
+			name: "all-fields",
+			silence: Silence{
+				Machine: "mlab1.lga0t.measurement-lab.org",
+				Site:    "lga0t",
+				Labels:  map[string]string{"module": "ssh_v4_online"},
+			},
+			want: true,
+		},
+		{
+			name:    "one-field-mismatch",
+			silence: Silence{Machine: "mlab1.lga0t.measurement-lab.org", Site: "iad0t"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.silence.Match(v); got != tt.want {
+				t.Errorf("Silence.Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSilence_Validate(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	tests := []struct {
+		name    string
+		silence Silence
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			silence: Silence{Site: "lga.*", Expires: expires, Author: "alice"},
+		},
+		{
+			name:    "no-matcher",
+			silence: Silence{Expires: expires, Author: "alice"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid-machine",
+			silence: Silence{Machine: "lga0t", Expires: expires, Author: "alice"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid-site",
+			silence: Silence{Site: "lga(", Expires: expires, Author: "alice"},
+			wantErr: true,
+		},
+		{
+			name:    "no-expiry",
+			silence: Silence{Site: "lga.*", Author: "alice"},
+			wantErr: true,
+		},
+		{
+			name:    "expired",
+			silence: Silence{Site: "lga.*", Expires: time.Now().Add(-time.Minute), Author: "alice"},
+			wantErr: true,
+		},
+		{
+			name:    "no-author",
+			silence: Silence{Site: "lga.*", Expires: expires},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.silence.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Silence.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && tt.silence.site == nil {
+				t.Errorf("Silence.Validate() did not compile the site regexp")
+			}
+		})
+	}
+}
+
+func TestSilences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "silences")
+	rtx.Must(err, "Cannot create temporary directory")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "silences.json")
+	s, err := ReadSilences(path)
+	if err != nil || len(s.List()) != 0 {
+		t.Fatalf("ReadSilences() = %v, %v, want no silences", s, err)
+	}
+
+	added, err := s.Add(Silence{
+		Machine: "mlab1.lga0t",
+		Expires: time.Now().Add(time.Hour),
+		Author:  "alice",
+		Comment: "flaky",
+	})
+	if err != nil {
+		t.Fatalf("Silences.Add() error = %v", err)
+	}
+	if added.ID == "" || added.Machine != "mlab1.lga0t.measurement-lab.org" {
+		t.Errorf("Silences.Add() = %v", added)
+	}
+	_, err = s.Add(Silence{Site: "iad.*"})
+	if err == nil {
+		t.Errorf("Silences.Add() of an invalid silence did not fail")
+	}
+
+	v := node.Verdict{Node: node.New("mlab1.lga0t.measurement-lab.org", "lga0t")}
+	if got, ok := s.Match(v); !ok || got.ID != added.ID {
+		t.Errorf("Silences.Match() = %v, %v", got, ok)
+	}
+
+	// The silences are persisted.
+	s, err = ReadSilences(path)
+	if err != nil || len(s.List()) != 1 {
+		t.Fatalf("ReadSilences() = %v, %v, want one silence", s.List(), err)
+	}
+
+	if ok, err := s.Remove("notfound"); ok || err != nil {
+		t.Errorf("Silences.Remove() = %v, %v, want false", ok, err)
+	}
+	if ok, err := s.Remove(added.ID); !ok || err != nil {
+		t.Errorf("Silences.Remove() = %v, %v, want true", ok, err)
+	}
+	if _, ok := s.Match(v); ok {
+		t.Errorf("Silences.Match() matched a removed silence")
+	}
+
+	// Expired silences are not listed nor matched.
+	s.silences = append(s.silences, Silence{
+		Machine: "mlab1.lga0t.measurement-lab.org",
+		Expires: time.Now().Add(-time.Minute),
+	})
+	if _, ok := s.Match(v); ok || len(s.List()) != 0 {
+		t.Errorf("Silences matched an expired silence")
+	}
+
+	// A corrupted file is an error.
+	rtx.Must(ioutil.WriteFile(path, []byte("{"), 0644), "Cannot write file")
+	if _, err = ReadSilences(path); err == nil {
+		t.Errorf("ReadSilences() of a corrupted file did not fail")
+	}
+}
@@ -7,9 +7,17 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/m-lab/go/memoryless"
@@ -17,11 +25,15 @@ import (
 
 	"github.com/m-lab/go/flagx"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/rebot/admin"
 	"github.com/m-lab/rebot/healthcheck"
 	"github.com/m-lab/rebot/history"
 	"github.com/m-lab/rebot/node"
+	"github.com/m-lab/rebot/notify"
 	"github.com/m-lab/rebot/promtest"
 	"github.com/m-lab/rebot/reboot"
+	"github.com/m-lab/rebot/schedule"
+	"github.com/m-lab/rebot/ticket"
 	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/client_golang/prometheus"
@@ -38,12 +50,29 @@ const (
 	// accommodate for nodes that are slow to respond and should be higher
 	// than the Reboot API's BMC connection timeout.
 	clientTimeout = 90 * time.Second
+
+	// Timeouts of the admin server. Requests are small, but a manual reboot
+	// waits for the running check, i.e. for its queries and reboot requests
+	// with their retries, before sending its own request and answering.
+	adminReadTimeout  = 30 * time.Second
+	adminWriteTimeout = 30 * time.Minute
 )
 
 var (
 	prom promtest.PromClient
 
+	// Criteria used to determine which nodes are offline.
+	healthConfig = healthcheck.DefaultConfig()
+
+	// Maintenance windows and blackouts. If nil, nodes can be rebooted at
+	// any time.
+	maintenance *schedule.Config
+
+	criteriaPath   string
+	schedulePath   string
 	historyPath    string
+	eventLogPath   string
+	silencesPath   string
 	rebootAddr     string
 	rebootUsername string
 	rebootPassword string
@@ -53,13 +82,65 @@ var (
 	dryRun  bool
 	oneshot bool
 
+	// Policy determining when a node can be rebooted again.
+	cooldown = history.DefaultPolicy()
+
+	// How reboot requests are sent.
+	rebootConfig = reboot.DefaultConfig()
+
+	// Which Rebooter is used: the Reboot API ("api") or the BMCs' Redfish
+	// API ("redfish").
+	rebootBackend      string
+	redfishCredentials string
+	redfishResetType   string
+	redfishInsecure    bool
+
+	// Limits on the number of nodes rebooted together.
+	budget = history.DefaultBudget()
+
+	// Log of every decision taken. It's nil until main() creates it.
+	eventLog         *history.EventLog
+	eventLogMaxSize  int64
+	eventLogMaxFiles int
+
+	// Notifications for humans. It's nil until main() creates it.
+	notifier       *notify.Notifier
+	notifyWebhook  string
+	notifyFile     string
+	notifySMTPAddr string
+	notifySMTPFrom string
+	notifySMTPTo   string
+	notifySMTPUser string
+	notifySMTPPass string
+	notifyInterval time.Duration
+
+	// Issues tracking the nodes that reboots do not fix. It's nil unless
+	// -ticket.repo is set.
+	tickets         *ticket.Tracker
+	ticketURL       string
+	ticketRepo      string
+	ticketToken     string
+	ticketLabels    string
+	ticketThreshold int
+
+	// Silences preventing the reboot of some nodes. It's nil until main()
+	// reads them.
+	silences *history.Silences
+
 	listenAddr string
 	project    string
 
+	adminAddr     string
+	adminUsername string
+	adminPassword string
+
 	minSleepTime time.Duration
 	maxSleepTime time.Duration
 	sleepTime    time.Duration
 
+	// How long to wait for the running check on shutdown.
+	shutdownTimeout time.Duration
+
 	// Prometheus metric for last time a machine was rebooted.
 	metricLastRebootTs = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -72,6 +153,14 @@ var (
 		},
 	)
 
+	// Prometheus metric for total number of failed reboot requests.
+	metricTotalFailures = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "rebot_reboot_failures_total",
+			Help: "Total number of failed reboot requests since startup.",
+		},
+	)
+
 	// Prometheus metric for total number of reboots.
 	metricTotalReboots = promauto.NewCounter(
 		prometheus.CounterOpts{
@@ -89,73 +178,422 @@ var (
 		},
 	)
 
+	// Prometheus metric for the time machines take to come back online after
+	// a reboot.
+	metricRecoveryTime = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "rebot_recovery_seconds",
+			Help: "Time between a reboot and the machine being observed " +
+				"online again.",
+			// From 1 minute to ~34 hours.
+			Buckets: prometheus.ExponentialBuckets(60, 2, 12),
+		},
+		[]string{
+			"site",
+		},
+	)
+
+	// Prometheus metric for the number of offline machines matched by each
+	// criterion during the last run.
+	metricCriterionMatches = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rebot_criterion_matches",
+			Help: "Number of offline machines matched by each criterion " +
+				"during the last run.",
+		},
+		[]string{
+			"criterion",
+			"type",
+		},
+	)
+
+	// Prometheus metric for the reboots not sent because of the budget.
+	metricOverBudget = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rebot_over_budget_total",
+			Help: "Total number of reboots not sent because a limit of the " +
+				"reboot budget was reached.",
+		},
+		[]string{
+			"limit",
+		},
+	)
+
+	// Prometheus metric for the number of reboots held by the schedule.
+	metricQueuedReboots = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rebot_queued_reboots",
+			Help: "Number of offline machines waiting for a maintenance " +
+				"window to be rebooted.",
+		},
+	)
+
 	ctx, cancel = context.WithCancel(context.Background())
 
+	// notifySignals relays the signals stopping rebot to c. This can be
+	// swapped to know when the signals are handled in unit tests.
+	notifySignals = func(c chan<- os.Signal) {
+		signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+	}
+
 	newRebooter = func(client *http.Client, baseURL, username,
 		password string) Rebooter {
-		return reboot.NewHTTPRebooter(client, baseURL, username, password)
+		if rebootBackend == "redfish" {
+			creds, err := reboot.LoadCredentials(redfishCredentials)
+			rtx.Must(err, "Cannot read the Redfish credentials file")
+			if redfishInsecure {
+				// BMCs usually have self-signed certificates.
+				client = &http.Client{
+					Timeout:   client.Timeout,
+					Transport: insecureTransport(),
+				}
+			}
+			return reboot.NewRedfishRebooter(client, creds, redfishResetType,
+				rebootConfig)
+		}
+		return reboot.NewHTTPRebooter(client, baseURL, username, password,
+			rebootConfig)
 	}
 )
 
-// Rebooter is an interface that allows to test reboot.HTTPRebooter.
+// Rebooter is an interface that allows to test reboot.HTTPRebooter and
+// reboot.RedfishRebooter.
 type Rebooter interface {
-	Many([]node.Node) map[string]error
+	Many(context.Context, []node.Node) reboot.Result
 }
 
-// filterRecent filters out nodes that were rebooted less than 24 hours ago.
-func filterRecent(candidates []node.Node, candidateHistory map[string]node.History) []node.Node {
-	filtered := make([]node.Node, 0)
-
-	for _, candidate := range candidates {
-		history, ok := candidateHistory[candidate.Name]
-		if ok {
-			// This candidate has been down before.
-			// Check to see if the previous time was w/in the past 24 hours
-			if time.Now().Sub(history.LastReboot) > 24*time.Hour {
-				filtered = append(filtered, candidate)
-			} else {
-				log.WithFields(log.Fields{"machine": history.Name, "LastReboot": history.LastReboot}).Info("The node was rebooted recently - skipping it.")
-			}
-		} else {
-			// New candidate - just add it to the list.
-			filtered = append(filtered, candidate)
+// updateCriterionMetrics sets the number of machines matched by each
+// criterion according to the provided verdicts.
+func updateCriterionMetrics(verdicts []node.Verdict) {
+	metricCriterionMatches.Reset()
+	for _, c := range healthConfig.Criteria {
+		if !c.Disabled {
+			metricCriterionMatches.WithLabelValues(c.Name, string(c.Kind))
+		}
+	}
+	for _, v := range verdicts {
+		for _, r := range v.Reasons {
+			metricCriterionMatches.WithLabelValues(r, string(healthcheck.Inclusion)).Inc()
+		}
+		for _, e := range v.Exclusions {
+			metricCriterionMatches.WithLabelValues(e, string(healthConfig.Kind(e))).Inc()
 		}
 	}
+}
 
+// rebooted returns the verdicts for the nodes that were actually rebooted
+// according to result.
+func rebooted(verdicts []node.Verdict, result reboot.Result) []node.Verdict {
+	names := map[string]bool{}
+	for _, n := range result.Rebooted {
+		names[n.Name] = true
+	}
+
+	filtered := make([]node.Verdict, 0)
+	for _, v := range verdicts {
+		if names[v.Name] {
+			filtered = append(filtered, v)
+		}
+	}
 	return filtered
 }
 
-// checkAndReboot implements Rebot's reboot logic.
-func checkAndReboot(h map[string]node.History, rebooter *reboot.HTTPRebooter) {
-	offline, err := healthcheck.GetOfflineNodes(prom, defaultMins)
+// recordEvents appends the events to the event log, if any. Nothing is
+// recorded in dry-run mode.
+func recordEvents(events ...history.Event) {
+	if eventLog == nil || dryRun {
+		return
+	}
 
-	metricOffline.Set(float64(len(offline)))
+	err := eventLog.Append(events...)
+	if err != nil {
+		log.WithError(err).Error("Cannot write to the event log.")
+	}
+}
 
-	if !dryRun {
-		history.UpdateStatus(offline, h)
+// writeHistory writes the history to historyPath, logging any error.
+func writeHistory(h map[string]node.History) {
+	err := history.Write(historyPath, h)
+	if err != nil {
+		log.WithError(err).Error("Cannot write the history file.")
 	}
+}
+
+// checkAndReboot implements Rebot's reboot logic. The caller must hold c.mu.
+func (c *controller) checkAndReboot() {
+	h := c.history
+	verdicts, complete, err := healthcheck.GetOfflineNodes(c.ctx, prom, healthConfig, defaultMins)
+	offline := node.Candidates(verdicts)
+
+	metricOffline.Set(float64(len(offline)))
+	updateCriterionMetrics(verdicts)
 
 	if err != nil {
 		log.Error("Unable to retrieve the list of rebootable nodes. " +
 			"Is Prometheus reachable?")
 		return
 	}
+	c.setVerdicts(verdicts)
+
+	// Excluded nodes are still offline. Without complete data, nodes that
+	// are not found offline cannot be considered online either.
+	if !dryRun && complete {
+		for _, n := range history.UpdateStatus(node.Nodes(verdicts), h) {
+			if d := n.RecoveryTime(); d > 0 {
+				metricRecoveryTime.WithLabelValues(n.Site).Observe(d.Seconds())
+			}
+			recordEvents(history.NewEvent(history.EventRecovered, n.Node))
+			notifier.Resolve(notify.RebootFailed, n.Name)
+			notifier.Resolve(notify.GaveUp, n.Name)
+		}
+	}
 
-	toReboot := filterRecent(offline, h)
+	for _, v := range verdicts {
+		e := history.NewEvent(history.EventCandidate, v.Node)
+		e.Reasons = v.Reasons
+		recordEvents(e)
+
+		if v.Excluded() {
+			log.WithFields(log.Fields{"machine": v.Name, "reasons": v.Reasons,
+				"exclusions": v.Exclusions}).Info("The node is excluded - skipping it.")
+			skipped := history.NewEvent(history.EventSkipped, v.Node)
+			skipped.Reason = "excluded: " + strings.Join(v.Exclusions, ", ")
+			recordEvents(skipped)
+		}
+	}
+
+	for _, n := range cooldown.MarkExhausted(h) {
+		notifier.Notify(notify.Notification{
+			Kind: notify.GaveUp,
+			Key:  n.Name,
+			Summary: fmt.Sprintf("%s is still offline after %d reboots",
+				n.Name, n.Attempts),
+			Machines: []string{n.Name},
+		})
+		tickets.Comment(n, fmt.Sprintf("rebot gave up after %d reboots: the "+
+			"machine won't be rebooted again until it's cleared.", n.Attempts))
+	}
 
 	if !dryRun {
-		rebooter.Many(toReboot)
+		tickets.Sync(h)
+	}
+
+	toReboot := make([]node.Verdict, 0)
+	for _, v := range offline {
+		reason := skipReason(v, h)
+		if reason != "" {
+			log.WithFields(log.Fields{"machine": v.Name, "reason": reason}).Info("Skipping node.")
+			skipped := history.NewEvent(history.EventSkipped, v.Node)
+			skipped.Reason = reason
+			recordEvents(skipped)
+			continue
+		}
+		toReboot = append(toReboot, v)
+	}
+
+	toReboot = c.hold(toReboot)
+
+	toReboot, over := budget.Allocate(toReboot, h, time.Now())
+	overSafetyLimit := []string{}
+	for _, v := range offline {
+		limit, ok := over[v.Name]
+		if !ok {
+			continue
+		}
+		log.WithFields(log.Fields{"machine": v.Name, "limit": limit}).Warn("Reboot budget exhausted - not rebooting node.")
+		metricOverBudget.WithLabelValues(string(limit)).Inc()
+		e := history.NewEvent(history.EventSkipped, v.Node)
+		e.Reason = fmt.Sprintf("over budget: %s limit reached", limit)
+		recordEvents(e)
+		if limit == history.LimitRun || limit == history.LimitWindow {
+			overSafetyLimit = append(overSafetyLimit, v.Name)
+		}
+	}
+
+	// Too many nodes offline at once usually means something is wrong
+	// beyond what reboots can fix.
+	if len(overSafetyLimit) == 0 {
+		notifier.Resolve(notify.BudgetExhausted, "")
+	} else if !dryRun {
+		notifier.Notify(notify.Notification{
+			Kind: notify.BudgetExhausted,
+			Summary: fmt.Sprintf("%d offline machines not rebooted: reboot budget exhausted",
+				len(overSafetyLimit)),
+			Machines: overSafetyLimit,
+		})
+	}
+
+	if dryRun {
+		for _, n := range toReboot {
+			log.WithFields(log.Fields{"machine": n.Name, "reasons": n.Reasons}).Info("Dry run - not rebooting node.")
+		}
+		return
 	}
 
+	// Reboots may have been paused while the check was running.
+	if c.Paused() {
+		for _, n := range toReboot {
+			log.WithFields(log.Fields{"machine": n.Name, "reasons": n.Reasons}).Info("Reboots are paused - not rebooting node.")
+			e := history.NewEvent(history.EventSkipped, n.Node)
+			e.Reason = "reboots paused"
+			recordEvents(e)
+		}
+		writeHistory(h)
+		return
+	}
+
+	c.sendReboots(toReboot)
+	writeHistory(h)
+}
+
+// hold removes from toReboot the nodes that cannot be rebooted now
+// according to the maintenance schedule and queues them, replacing the
+// previous queue. A check is scheduled for when the first of them can be
+// rebooted: if it's still offline by then, it will be rebooted. The caller
+// must hold c.mu.
+func (c *controller) hold(toReboot []node.Verdict) []node.Verdict {
+	now := time.Now()
+	allowed := make([]node.Verdict, 0, len(toReboot))
+	queue := map[string]node.Verdict{}
+	var next time.Time
+
+	for _, v := range toReboot {
+		reason := maintenance.HoldReason(v.Node, project, now)
+		if reason == "" {
+			allowed = append(allowed, v)
+			continue
+		}
+
+		log.WithFields(log.Fields{"machine": v.Name, "reason": reason}).Info("Holding reboot.")
+		e := history.NewEvent(history.EventSkipped, v.Node)
+		e.Reason = "held: " + reason
+		recordEvents(e)
+
+		queue[v.Name] = v
+		open := maintenance.NextOpen(v.Node, project, now)
+		if !open.IsZero() && (next.IsZero() || open.Before(next)) {
+			next = open
+		}
+	}
+
+	for name := range c.queue {
+		if _, ok := queue[name]; !ok {
+			log.WithField("machine", name).Info("Removing node from the reboot queue.")
+		}
+	}
+	c.queue = queue
+	metricQueuedReboots.Set(float64(len(queue)))
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !next.IsZero() {
+		log.WithField("time", next).Info("Scheduling a check for the queued reboots.")
+		c.timer = time.AfterFunc(time.Until(next), c.Check)
+	}
+
+	return allowed
+}
+
+// sendReboots sends the reboot requests for the verdicts, and records the
+// outcome in the history, the event log and the metrics. The caller must
+// hold c.mu.
+func (c *controller) sendReboots(toReboot []node.Verdict) reboot.Result {
+	h := c.history
 	for _, n := range toReboot {
+		e := history.NewEvent(history.EventRebootSent, n.Node)
+		e.Reasons = n.Reasons
+		recordEvents(e)
+	}
+
+	result := c.rebooter.Many(c.ctx, node.Nodes(toReboot))
+
+	for _, n := range toReboot {
+		err, ok := result.Failed[n.Name]
+		if !ok {
+			continue
+		}
+		log.WithError(err).WithField("machine", n.Name).Error("Reboot failed.")
+		e := history.NewEvent(history.EventRebootFailed, n.Node)
+		e.Error = err.Error()
+		recordEvents(e)
+		notifier.Notify(notify.Notification{
+			Kind:     notify.RebootFailed,
+			Key:      n.Name,
+			Summary:  fmt.Sprintf("Reboot of %s failed", n.Name),
+			Machines: []string{n.Name},
+			Error:    err.Error(),
+		})
+	}
+	metricTotalFailures.Add(float64(len(result.Failed)))
+	history.UpdateFailed(toReboot, result.Failed, h)
+
+	done := rebooted(toReboot, result)
+	for _, n := range done {
+		log.WithFields(log.Fields{"machine": n.Name, "reasons": n.Reasons}).Info("Node rebooted.")
 		metricLastRebootTs.WithLabelValues(n.Name, n.Site).SetToCurrentTime()
+		e := history.NewEvent(history.EventRebootSucceeded, n.Node)
+		e.Reasons = n.Reasons
+		recordEvents(e)
 	}
 
-	metricTotalReboots.Add(float64(len(toReboot)))
+	metricTotalReboots.Add(float64(len(done)))
 
-	history.Update(toReboot, h)
-	history.Write(defaultHistoryPath, h)
+	history.Update(done, h)
+	for _, n := range done {
+		tickets.Comment(h[n.Name], fmt.Sprintf("Rebooted again (attempt %d): %s",
+			h[n.Name].Attempts, strings.Join(n.Reasons, ", ")))
+	}
+	return result
+}
 
+// insecureTransport returns a transport with the settings of
+// http.DefaultTransport, including its dial and TLS handshake timeouts, that
+// does not verify TLS certificates. It's built field by field since
+// http.Transport.Clone requires Go 1.13.
+func insecureTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+	}
+}
+
+// skipReason returns why the verdict's node must not be rebooted, because
+// it's silenced or according to its history, or an empty string if it can
+// be rebooted.
+func skipReason(v node.Verdict, h map[string]node.History) string {
+	if silences != nil {
+		if s, ok := silences.Match(v); ok {
+			return s.String()
+		}
+	}
+	return cooldown.SkipReason(v.Node, h)
+}
+
+// newNotifier returns a Notifier sending to the sinks configured via
+// flags. Without sinks, notifications are only logged.
+func newNotifier(client *http.Client) *notify.Notifier {
+	sinks := []notify.Sink{}
+	if notifyWebhook != "" {
+		sinks = append(sinks, notify.NewWebhookSink(client, notifyWebhook))
+	}
+	if notifySMTPAddr != "" {
+		sinks = append(sinks, notify.NewSMTPSink(notifySMTPAddr, notifySMTPFrom,
+			strings.Split(notifySMTPTo, ","), notifySMTPUser, notifySMTPPass))
+	}
+	if notifyFile != "" {
+		sinks = append(sinks, notify.NewFileSink(notifyFile))
+	}
+	return notify.New(notifyInterval, sinks...)
 }
 
 // initPrometheusClient initializes a Prometheus client with HTTP basic
@@ -178,8 +616,6 @@ func initPrometheusClient() {
 // init initializes the Prometheus metrics and drops any passed flags into
 // global variables.
 func init() {
-	historyPath = defaultHistoryPath
-
 	log.SetLevel(log.DebugLevel)
 
 	flag.BoolVar(&dryRun, "dryrun", false,
@@ -188,18 +624,140 @@ func init() {
 		"Execute just once, do not loop.")
 	flag.StringVar(&listenAddr, "listenaddr", ":9999",
 		"Address to listen on for telemetry.")
+	flag.StringVar(&adminAddr, "admin.addr", "localhost:9998",
+		"Address to listen on for the admin API. Empty to disable it.")
+	flag.StringVar(&adminUsername, "admin.username", "",
+		"Username for the admin API.")
+	flag.StringVar(&adminPassword, "admin.password", "",
+		"Password for the admin API.")
+	flag.StringVar(&rebootBackend, "reboot.backend", "api",
+		"How to reboot machines: \"api\" through the Reboot API or "+
+			"\"redfish\" through the Redfish API of their BMC.")
+	flag.StringVar(&redfishCredentials, "redfish.credentials", "",
+		"Path of the JSON file with the BMCs' credentials, for "+
+			"-reboot.backend=redfish.")
+	flag.StringVar(&redfishResetType, "redfish.resettype", reboot.ForceRestart,
+		"Redfish reset type to use if the BMC supports it: ForceRestart or "+
+			"PowerCycle.")
+	flag.BoolVar(&redfishInsecure, "redfish.insecure", false,
+		"Do not verify the BMCs' TLS certificates.")
 	flag.StringVar(&rebootAddr, "reboot.addr", "",
 		"Reboot API instance to send reboot request to.")
 	flag.StringVar(&rebootUsername, "reboot.username", "",
 		"Username for the Reboot API.")
 	flag.StringVar(&rebootPassword, "reboot.password", "",
 		"Password for the Reboot API.")
+	flag.DurationVar(&rebootConfig.Timeout, "reboot.timeout",
+		rebootConfig.Timeout, "Timeout of each reboot request.")
+	flag.IntVar(&rebootConfig.Concurrency, "reboot.concurrency",
+		rebootConfig.Concurrency,
+		"Maximum number of reboot requests sent at once. Nodes of the same "+
+			"site are rebooted one at a time.")
+	flag.IntVar(&rebootConfig.Retries, "reboot.retries", rebootConfig.Retries,
+		"Maximum number of retries of a reboot request that was not "+
+			"received (transient error or 503 response).")
+	flag.DurationVar(&rebootConfig.Backoff, "reboot.backoff",
+		rebootConfig.Backoff,
+		"Time before the first retry of a reboot request, doubled for each "+
+			"following retry.")
+	flag.IntVar(&rebootConfig.BreakerThreshold, "reboot.breaker.threshold",
+		rebootConfig.BreakerThreshold,
+		"Number of consecutive reboots failing on the Reboot API's side, "+
+			"retries included, after which no reboot request is sent for "+
+			"-reboot.breaker.cooldown. 0 to disable.")
+	flag.DurationVar(&rebootConfig.BreakerCooldown, "reboot.breaker.cooldown",
+		rebootConfig.BreakerCooldown,
+		"Time after which a single reboot request is sent to check whether "+
+			"the Reboot API is back.")
+	flag.DurationVar(&healthConfig.QueryTimeout, "prometheus.timeout",
+		healthConfig.QueryTimeout, "Timeout of each Prometheus query.")
 	flag.StringVar(&promUsername, "prometheus.username", "",
 		"Username for Prometheus.")
 	flag.StringVar(&promPassword, "prometheus.password", "",
 		"Password for Prometheus.")
+	flag.StringVar(&historyPath, "historypath", defaultHistoryPath,
+		"Path to the history file. Its directory must be writable.")
+	flag.StringVar(&eventLogPath, "eventlog", "",
+		"Path to the event log. If empty, events.jsonl in the history "+
+			"file's directory is used.")
+	flag.StringVar(&notifyWebhook, "notify.webhook", "",
+		"URL to POST notifications to, as JSON.")
+	flag.StringVar(&notifySMTPAddr, "notify.smtp.addr", "",
+		"SMTP server (host:port) to send notification emails through.")
+	flag.StringVar(&notifySMTPFrom, "notify.smtp.from", "",
+		"Sender of the notification emails.")
+	flag.StringVar(&notifySMTPTo, "notify.smtp.to", "",
+		"Comma-separated recipients of the notification emails.")
+	flag.StringVar(&notifySMTPUser, "notify.smtp.username", "",
+		"Username for the SMTP server.")
+	flag.StringVar(&notifySMTPPass, "notify.smtp.password", "",
+		"Password for the SMTP server.")
+	flag.StringVar(&notifyFile, "notify.file", "",
+		"File to append notifications to, as JSON lines.")
+	flag.DurationVar(&notifyInterval, "notify.interval", 24*time.Hour,
+		"Minimum time before notifying the same condition again.")
+	flag.StringVar(&ticketRepo, "ticket.repo", "",
+		"Repository (owner/name) to open issues in for the machines still "+
+			"offline after -ticket.threshold reboots. Empty to disable.")
+	flag.StringVar(&ticketURL, "ticket.url", ticket.DefaultURL,
+		"Base URL of the GitHub-compatible issues API.")
+	flag.StringVar(&ticketToken, "ticket.token", "",
+		"Token for the issues API.")
+	flag.StringVar(&ticketLabels, "ticket.labels", "rebot",
+		"Comma-separated labels of the issues.")
+	flag.IntVar(&ticketThreshold, "ticket.threshold", 3,
+		"Number of consecutive reboots that did not bring a machine back "+
+			"online after which an issue is opened.")
+	flag.StringVar(&silencesPath, "silences", "",
+		"Path to the silences file. If empty, silences.json in the history "+
+			"file's directory is used.")
+	flag.Int64Var(&eventLogMaxSize, "eventlog.maxsize", 10*1024*1024,
+		"Size in bytes after which the event log is rotated.")
+	flag.IntVar(&eventLogMaxFiles, "eventlog.maxfiles", 10,
+		"Number of rotated event log files to keep.")
+	flag.DurationVar(&cooldown.Interval, "rebootinterval", cooldown.Interval,
+		"Minimum time between two reboots of the same node.")
+	flag.DurationVar(&cooldown.RetryInterval, "retryinterval",
+		cooldown.RetryInterval,
+		"Minimum time before retrying a failed reboot request.")
+	flag.Float64Var(&cooldown.Backoff, "backoff", cooldown.Backoff,
+		"Factor the reboot interval is multiplied by after each reboot "+
+			"that did not bring the node back online.")
+	flag.IntVar(&cooldown.MaxAttempts, "maxattempts", cooldown.MaxAttempts,
+		"Maximum number of consecutive reboots that did not bring the node "+
+			"back online, after which the node needs a human (0 = no limit).")
+	flag.IntVar(&budget.PerRun, "budget.run", budget.PerRun,
+		"Maximum number of nodes rebooted in a single run. 0 for no limit.")
+	flag.IntVar(&budget.PerSite, "budget.site", budget.PerSite,
+		"Maximum number of nodes of the same site rebooted in a single run. "+
+			"0 for no limit.")
+	flag.IntVar(&budget.PerMetro, "budget.metro", budget.PerMetro,
+		"Maximum number of nodes of the same metro rebooted in a single "+
+			"run. 0 for no limit.")
+	flag.IntVar(&budget.PerWindow, "budget.window", budget.PerWindow,
+		"Maximum number of nodes rebooted over -budget.windowlength. 0 for "+
+			"no limit.")
+	flag.DurationVar(&budget.Window, "budget.windowlength", budget.Window,
+		"Length of the rolling window for -budget.window.")
+	flag.IntVar(&budget.Concurrent, "sequence.persite", budget.Concurrent,
+		"Maximum number of nodes of the same site rebooting at the same "+
+			"time. 0 for no limit.")
+	flag.DurationVar(&budget.RecoveryTimeout, "sequence.timeout",
+		budget.RecoveryTimeout,
+		"Time after which a rebooted node that is still offline does not "+
+			"count as rebooting anymore for -sequence.persite.")
+	flag.StringVar(&criteriaPath, "criteria", "",
+		"Path to a JSON file with the reboot criteria. If empty, the "+
+			"built-in criteria are used.")
+	flag.StringVar(&schedulePath, "schedule", "",
+		"Path to a JSON file with the maintenance windows and blackouts. "+
+			"If empty, machines can be rebooted at any time.")
 	flag.StringVar(&project, "project", defaultProject,
 		"Project to use for Prometheus.")
+	flag.DurationVar(&shutdownTimeout, "shutdown.timeout", 2*time.Minute,
+		"How long to wait for the running check to complete on SIGTERM. It "+
+			"should be longer than a reboot request and shorter than the "+
+			"termination grace period.")
 	flag.DurationVar(&sleepTime, "sleeptime", 30*time.Minute,
 		"How long to sleep between reboot attempts on average")
 	// TODO: decide if min and max really need to be so close to avg. Rule of thumb
@@ -215,27 +773,163 @@ func main() {
 	flag.Parse()
 	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not parse env vars")
 
+	// Subcommands talk to the admin API of a running instance.
+	if flag.NArg() > 0 {
+		rtx.Must(runCommand(flag.Args()), "Command failed")
+		return
+	}
+
+	var err error
+	if criteriaPath != "" {
+		queryTimeout := healthConfig.QueryTimeout
+		healthConfig, err = healthcheck.LoadConfig(criteriaPath)
+		rtx.Must(err, "Cannot load the criteria file")
+		healthConfig.QueryTimeout = queryTimeout
+	}
+	if schedulePath != "" {
+		maintenance, err = schedule.LoadConfig(schedulePath)
+		rtx.Must(err, "Cannot load the schedule file")
+	}
+
 	initPrometheusClient()
 	srv := prometheusx.MustServeMetrics()
-	defer srv.Shutdown(ctx)
-
-	// First, check to see if there's an existing candidate history file.
-	candidateHistory := history.Read(historyPath)
 
 	// Create the HTTP client to send requests to the API.
 	client := &http.Client{
 		Timeout: clientTimeout,
 	}
 
-	// Create the HTTPRebooter.
-	rebooter := reboot.NewHTTPRebooter(client, rebootAddr, rebootUsername, rebootPassword)
+	notifier = newNotifier(client)
+
+	// First, check to see if there's an existing candidate history file.
+	rtx.Must(history.CheckWritable(historyPath),
+		"The history file's directory is not writable")
+
+	// If the file is corrupted, refuse to start: without the history, every
+	// offline node would be rebooted regardless of recent reboots. A known
+	// corruption was already notified before a previous restart.
+	candidateHistory, err := history.Read(historyPath)
+	if corrupt, ok := err.(*history.CorruptError); ok && !corrupt.Known {
+		notifier.Notify(notify.Notification{
+			Kind:    notify.HistoryCorrupted,
+			Key:     corrupt.Path,
+			Summary: "The history file is corrupted, rebot cannot start",
+			Error:   corrupt.Error(),
+		})
+	}
+	rtx.Must(err, "Cannot read the history file")
+
+	if eventLogPath == "" {
+		eventLogPath = filepath.Join(filepath.Dir(historyPath), "events.jsonl")
+	}
+	eventLog = history.NewEventLog(eventLogPath, eventLogMaxSize, eventLogMaxFiles)
+
+	if ticketRepo != "" {
+		if ticketThreshold < 1 {
+			log.Fatal("-ticket.threshold must be at least 1")
+		}
+		var labels []string
+		if ticketLabels != "" {
+			labels = strings.Split(ticketLabels, ",")
+		}
+		tickets = ticket.NewTracker(
+			ticket.NewClient(client, ticketURL, ticketRepo, ticketToken),
+			ticketThreshold, labels, eventLog)
+	}
+
+	if silencesPath == "" {
+		silencesPath = filepath.Join(filepath.Dir(historyPath), "silences.json")
+	}
+	silences, err = history.ReadSilences(silencesPath)
+	rtx.Must(err, "Cannot read the silences file")
+
+	// Create the Rebooter.
+	switch rebootBackend {
+	case "api":
+	case "redfish":
+		if redfishResetType != reboot.ForceRestart && redfishResetType != reboot.PowerCycle {
+			log.Fatalf("-redfish.resettype must be %s or %s", reboot.ForceRestart,
+				reboot.PowerCycle)
+		}
+	default:
+		log.Fatalf("Unknown -reboot.backend %q", rebootBackend)
+	}
+	rebooter := newRebooter(client, rebootAddr, rebootUsername, rebootPassword)
+	c := newController(candidateHistory, rebooter)
+
+	var adminSrv *http.Server
+	if adminAddr != "" {
+		adminSrv = &http.Server{
+			Addr:         adminAddr,
+			Handler:      admin.NewHandler(c, adminUsername, adminPassword),
+			ReadTimeout:  adminReadTimeout,
+			WriteTimeout: adminWriteTimeout,
+		}
+		go func() {
+			err := adminSrv.ListenAndServe()
+			if err != http.ErrServerClosed {
+				log.WithError(err).Error("Admin server stopped.")
+			}
+		}()
+	}
 
-	defer cancel()
+	// Stop scheduling checks on SIGTERM (e.g. when the pod is evicted) or
+	// SIGINT.
+	runCtx, stop := ctx, cancel
+	signals := make(chan os.Signal, 1)
+	notifySignals(signals)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case s := <-signals:
+			log.WithField("signal", s).Info("Shutting down...")
+			stop()
+		case <-runCtx.Done():
+		}
+	}()
 
 	rand.Seed(time.Now().UTC().UnixNano())
 
-	memoryless.Run(
-		ctx,
-		func() { checkAndReboot(candidateHistory, rebooter) },
-		memoryless.Config{Min: minSleepTime, Expected: sleepTime, Max: maxSleepTime, Once: oneshot})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		memoryless.Run(
+			runCtx,
+			c.run,
+			memoryless.Config{Min: minSleepTime, Expected: sleepTime, Max: maxSleepTime, Once: oneshot})
+	}()
+	select {
+	case <-done:
+		stop()
+	case <-runCtx.Done():
+	}
+
+	shutdown(c, adminSrv, srv)
+}
+
+// shutdown stops the admin server, lets the running check complete within
+// shutdownTimeout, writes the history and finally stops the metrics server.
+// adminSrv can be nil.
+func shutdown(c *controller, adminSrv, metricsSrv *http.Server) {
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer shutdownCancel()
+
+	if adminSrv != nil {
+		err := adminSrv.Shutdown(shutdownCtx)
+		if err != nil {
+			log.WithError(err).Error("Cannot shut down the admin server.")
+		}
+	}
+
+	err := c.Stop(shutdownCtx)
+	if err != nil {
+		log.WithError(err).Error("The running check did not complete in time " +
+			"and was cancelled.")
+	}
+
+	err = metricsSrv.Shutdown(shutdownCtx)
+	if err != nil {
+		log.WithError(err).Error("Cannot shut down the metrics server.")
+	}
+	log.Info("Shutdown complete.")
 }
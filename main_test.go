@@ -1,20 +1,33 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"fmt"
+	"errors"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	promlint "github.com/m-lab/go/prometheusx/promtest"
 
 	"github.com/m-lab/go/osx"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/rebot/admin"
 	"github.com/m-lab/rebot/healthcheck"
+	"github.com/m-lab/rebot/history"
 	"github.com/m-lab/rebot/node"
+	"github.com/m-lab/rebot/notify"
 	"github.com/m-lab/rebot/promtest"
+	"github.com/m-lab/rebot/reboot"
+	"github.com/m-lab/rebot/schedule"
+	"github.com/m-lab/rebot/ticket"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
 	log "github.com/sirupsen/logrus"
 )
@@ -25,12 +38,43 @@ const (
 
 var (
 	fakeProm *promtest.PrometheusMockClient
+
+	// Nodes returned by fakeProm for the ssh-down criterion.
+	fakeOfflineNodes model.Vector
 )
 
-type MockRebooter struct{}
+// MockRebooter reboots every node except those in fail, for which it
+// returns an error. If called is not nil, calls are notified to it without
+// blocking. If slow is true, Many only returns once ctx is done, as if the
+// requests were sent but answered too late.
+type MockRebooter struct {
+	fail   map[string]bool
+	called chan<- struct{}
+	slow   bool
+}
 
-func (r *MockRebooter) Many([]node.Node) map[string]error {
-	return map[string]error{}
+func (r *MockRebooter) Many(ctx context.Context, nodes []node.Node) reboot.Result {
+	if r.called != nil {
+		select {
+		case r.called <- struct{}{}:
+		default:
+		}
+	}
+	if r.slow {
+		<-ctx.Done()
+	}
+	result := reboot.Result{
+		Rebooted: []node.Node{},
+		Failed:   map[string]error{},
+	}
+	for _, n := range nodes {
+		if r.fail[n.Name] {
+			result.Failed[n.Name] = errors.New("reboot failed")
+			continue
+		}
+		result.Rebooted = append(result.Rebooted, n)
+	}
+	return result
 }
 
 func init() {
@@ -46,18 +90,34 @@ func init() {
 		"site":     "iad0t",
 	}, 0, now)
 
-	offlineNodes := model.Vector{
+	fakeOfflineNodes = model.Vector{
 		fakeOfflineNode,
 	}
 
-	fakeProm.Register(fmt.Sprintf(healthcheck.CandidatesQuery, testMins), offlineNodes, nil)
+	config := healthcheck.DefaultConfig()
+	for _, c := range append(config.Criteria, config.Activity.Criterion()) {
+		query, err := c.Render(config.Params(testMins))
+		rtx.Must(err, "Cannot render query for criterion %s", c.Name)
+		switch {
+		case c.Name == "ssh-down":
+			fakeProm.Register(query, fakeOfflineNodes, nil)
+		case c.Kind == healthcheck.Precondition:
+			fakeProm.Register(query, model.Vector{
+				promtest.CreateSample(nil, testMins, now)}, nil)
+		default:
+			fakeProm.Register(query, model.Vector{}, nil)
+		}
+	}
 
 	prom = fakeProm
 }
 
 const (
-	testHistoryPath = "history"
-	testRebootCmd   = "./drac_test.sh"
+	testHistoryPath   = "testhistory.json"
+	testEventLog      = "testevents.jsonl"
+	testSilencesPath  = "testsilences.json"
+	testNotifications = "testnotifications.jsonl"
+	testRebootCmd     = "./drac_test.sh"
 )
 
 func removeFiles(files ...string) {
@@ -69,77 +129,647 @@ func removeFiles(files ...string) {
 	}
 }
 
+// saveGlobals returns a function restoring the globals main() sets, so that
+// they don't leak into the other tests.
+func saveGlobals() func() {
+	oldEventLog, oldNotifier, oldSilences, oldTickets := eventLog, notifier,
+		silences, tickets
+	return func() {
+		eventLog, notifier, silences, tickets = oldEventLog, oldNotifier,
+			oldSilences, oldTickets
+	}
+}
+
 func Test_initPrometheusClient(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		initPrometheusClient()
 	})
 }
 
-func Test_filterRecent(t *testing.T) {
+func Test_checkAndReboot(t *testing.T) {
+	oldHistoryPath := historyPath
+	historyPath = testHistoryPath
+	defer func() { historyPath = oldHistoryPath }()
+	defer os.Remove(testHistoryPath)
+
+	t.Run("success", func(t *testing.T) {
+		h := map[string]node.History{}
+		newController(h, &MockRebooter{}).checkAndReboot()
+
+		if _, ok := h["mlab1.iad0t.measurement-lab.org"]; !ok {
+			t.Errorf("checkAndReboot() did not update the history: %v", h)
+		}
+	})
+
+	t.Run("success-events", func(t *testing.T) {
+		// Start from an empty log, whatever the previous tests left.
+		os.Remove(testEventLog)
+		eventLog = history.NewEventLog(testEventLog, 0, 0)
+		defer func() { eventLog = nil }()
+		defer removeFiles(testEventLog)
+
+		newController(map[string]node.History{}, &MockRebooter{}).checkAndReboot()
+
+		events, err := history.ReadEvents(testEventLog, history.Query{})
+		if err != nil {
+			t.Fatalf("ReadEvents() error = %v", err)
+		}
+		var types []history.EventType
+		for _, e := range events {
+			types = append(types, e.Type)
+		}
+		want := []history.EventType{history.EventCandidate,
+			history.EventRebootSent, history.EventRebootSucceeded}
+		if !reflect.DeepEqual(types, want) {
+			t.Errorf("checkAndReboot() recorded %v, want %v", types, want)
+		}
+	})
 
-	h := map[string]node.History{
-		"mlab1.iad0t.measurement-lab.org": node.NewHistory(
-			"mlab1.iad0t.measurement-lab.org", "iad0t", time.Now()),
-		"mlab2.iad0t.measurement-lab.org": node.NewHistory(
-			"mlab.iad0t.measurement-lab.org", "iad0t",
-			time.Now().Add(-25*time.Hour)),
-		"mlab1.iad1t.measurement-lab.org": node.NewHistory(
-			"mlab1.iad1t.measurement-lab.org", "iad1t",
-			time.Now().Add(-23*time.Hour)),
+	t.Run("failure-not-recorded", func(t *testing.T) {
+		h := map[string]node.History{}
+		newController(h, &MockRebooter{
+			fail: map[string]bool{"mlab1.iad0t.measurement-lab.org": true},
+		}).checkAndReboot()
+
+		hist, ok := h["mlab1.iad0t.measurement-lab.org"]
+		if !ok || hist.Status != node.RebootFailed || hist.Error == "" ||
+			!hist.LastReboot.IsZero() {
+			t.Errorf("checkAndReboot() did not record a failed reboot: %v", h)
+		}
+	})
+
+	t.Run("failure-notified", func(t *testing.T) {
+		notifier = notify.New(time.Hour, notify.NewFileSink(testNotifications))
+		defer func() { notifier = nil }()
+		defer removeFiles(testNotifications)
+
+		newController(map[string]node.History{}, &MockRebooter{
+			fail: map[string]bool{"mlab1.iad0t.measurement-lab.org": true},
+		}).checkAndReboot()
+
+		content, err := ioutil.ReadFile(testNotifications)
+		rtx.Must(err, "Cannot read notifications")
+		if !strings.Contains(string(content), string(notify.RebootFailed)) {
+			t.Errorf("checkAndReboot() did not notify the failure: %s", content)
+		}
+	})
+
+	t.Run("silenced", func(t *testing.T) {
+		var err error
+		silences, err = history.ReadSilences(testSilencesPath)
+		rtx.Must(err, "Cannot read silences")
+		defer func() { silences = nil }()
+		defer removeFiles(testSilencesPath)
+
+		_, err = silences.Add(history.Silence{
+			Labels:  map[string]string{"module": "ssh_v4_online"},
+			Expires: time.Now().Add(time.Hour),
+			Author:  "alice",
+		})
+		rtx.Must(err, "Cannot add silence")
+
+		h := map[string]node.History{}
+		newController(h, &MockRebooter{}).checkAndReboot()
+		if _, ok := h["mlab1.iad0t.measurement-lab.org"]; ok {
+			t.Errorf("checkAndReboot() rebooted a silenced node: %v", h)
+		}
+	})
+
+	t.Run("held", func(t *testing.T) {
+		now := time.Now().UTC()
+		maintenance = &schedule.Config{Blackouts: []schedule.Blackout{{
+			Start: now.Add(-time.Hour),
+			End:   now.Add(time.Hour),
+		}}}
+		rtx.Must(maintenance.Validate(), "Invalid schedule")
+		defer func() { maintenance = nil }()
+
+		h := map[string]node.History{}
+		c := newController(h, &MockRebooter{})
+		c.checkAndReboot()
+		defer c.timer.Stop()
+
+		if _, ok := h["mlab1.iad0t.measurement-lab.org"]; ok {
+			t.Errorf("checkAndReboot() rebooted a node during a blackout: %v", h)
+		}
+		if _, ok := c.queue["mlab1.iad0t.measurement-lab.org"]; !ok || c.timer == nil {
+			t.Errorf("checkAndReboot() did not queue the held node: %v", c.queue)
+		}
+
+		// Once the blackout is over, the queued node is rebooted.
+		maintenance = nil
+		c.checkAndReboot()
+		if _, ok := h["mlab1.iad0t.measurement-lab.org"]; !ok || len(c.queue) != 0 {
+			t.Errorf("checkAndReboot() did not reboot the queued node: %v", h)
+		}
+	})
+
+	t.Run("over-budget", func(t *testing.T) {
+		oldBudget := budget
+		budget = history.Budget{PerWindow: 1, Window: time.Hour}
+		defer func() { budget = oldBudget }()
+
+		// Another node was rebooted a few minutes ago.
+		h := map[string]node.History{
+			"mlab2.iad0t.measurement-lab.org": node.NewHistory(
+				"mlab2.iad0t.measurement-lab.org", "iad0t",
+				time.Now().Add(-5*time.Minute)),
+		}
+		notifier = notify.New(time.Hour, notify.NewFileSink(testNotifications))
+		defer func() { notifier = nil }()
+		defer removeFiles(testNotifications)
+
+		newController(h, &MockRebooter{}).checkAndReboot()
+		if _, ok := h["mlab1.iad0t.measurement-lab.org"]; ok {
+			t.Errorf("checkAndReboot() rebooted a node over budget: %v", h)
+		}
+		content, err := ioutil.ReadFile(testNotifications)
+		rtx.Must(err, "Cannot read notifications")
+		if !strings.Contains(string(content), string(notify.BudgetExhausted)) {
+			t.Errorf("checkAndReboot() did not notify the exhausted budget: %s", content)
+		}
+	})
+
+	t.Run("ticket", func(t *testing.T) {
+		var requests []string
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			requests = append(requests, req.Method+" "+req.URL.Path)
+			rw.WriteHeader(http.StatusCreated)
+			rw.Write([]byte(`{"number": 7}`))
+		}))
+		defer srv.Close()
+		tickets = ticket.NewTracker(
+			ticket.NewClient(http.DefaultClient, srv.URL, "m-lab/ops", "token"),
+			2, nil, nil)
+		defer func() { tickets = nil }()
+
+		// The node is still offline after two reboots, the last one a week
+		// ago.
+		hist := node.NewHistory("mlab1.iad0t.measurement-lab.org", "iad0t",
+			time.Now().Add(-7*24*time.Hour))
+		hist.Attempts = 2
+		h := map[string]node.History{hist.Name: hist}
+		newController(h, &MockRebooter{}).checkAndReboot()
+
+		want := []string{"POST /repos/m-lab/ops/issues",
+			"POST /repos/m-lab/ops/issues/7/comments"}
+		if !reflect.DeepEqual(requests, want) {
+			t.Errorf("checkAndReboot() sent %v, want %v", requests, want)
+		}
+		if h[hist.Name].Issue != 7 || h[hist.Name].Attempts != 3 {
+			t.Errorf("checkAndReboot() did not keep the issue: %+v", h[hist.Name])
+		}
+	})
+
+	t.Run("prometheus-error", func(t *testing.T) {
+		oldProm := prom
+		prom = promtest.NewPrometheusMockClient()
+		defer func() { prom = oldProm }()
+
+		// A node rebooted an hour ago must not be considered recovered.
+		hist := node.NewHistory("mlab2.iad0t.measurement-lab.org", "iad0t",
+			time.Now().Add(-time.Hour))
+		hist.Attempts = 2
+		h := map[string]node.History{hist.Name: hist}
+		newController(h, &MockRebooter{}).checkAndReboot()
+
+		want := map[string]node.History{hist.Name: hist}
+		if !reflect.DeepEqual(h, want) {
+			t.Errorf("checkAndReboot() updated the history on error: %v, want %v", h, want)
+		}
+	})
+
+	t.Run("data-gap", func(t *testing.T) {
+		// Every query returns an empty vector, preconditions included.
+		gap := promtest.NewPrometheusMockClient()
+		config := healthcheck.DefaultConfig()
+		for _, c := range append(config.Criteria, config.Activity.Criterion()) {
+			query, err := c.Render(config.Params(testMins))
+			rtx.Must(err, "Cannot render query for criterion %s", c.Name)
+			gap.Register(query, model.Vector{}, nil)
+		}
+		oldProm := prom
+		prom = gap
+		defer func() { prom = oldProm }()
+
+		hist := node.NewHistory("mlab2.iad0t.measurement-lab.org", "iad0t",
+			time.Now().Add(-time.Hour))
+		hist.Status = node.ObservedOffline
+		hist.Attempts = 3
+		h := map[string]node.History{hist.Name: hist}
+		newController(h, &MockRebooter{}).checkAndReboot()
+
+		if got := h[hist.Name]; got.Status != node.ObservedOffline || got.Attempts != 3 {
+			t.Errorf("checkAndReboot() considered a node online during a data gap: %+v", got)
+		}
+	})
+
+	t.Run("excluded-still-offline", func(t *testing.T) {
+		config := healthcheck.DefaultConfig()
+		activity, err := config.Activity.Criterion().Render(config.Params(testMins))
+		rtx.Must(err, "Cannot render the activity query")
+		fakeProm.Register(activity, fakeOfflineNodes, nil)
+		defer fakeProm.Register(activity, model.Vector{}, nil)
+
+		hist := node.NewHistory("mlab1.iad0t.measurement-lab.org", "iad0t",
+			time.Now().Add(-48*time.Hour))
+		hist.Attempts = 1
+		h := map[string]node.History{hist.Name: hist}
+		newController(h, &MockRebooter{}).checkAndReboot()
+
+		if got := h[hist.Name]; got.Status != node.ObservedOffline || got.Attempts != 1 {
+			t.Errorf("checkAndReboot() considered an excluded node online: %+v", got)
+		}
+	})
+
+	t.Run("paused", func(t *testing.T) {
+		h := map[string]node.History{}
+		c := newController(h, &MockRebooter{})
+		c.Pause()
+		c.checkAndReboot()
+
+		if _, ok := h["mlab1.iad0t.measurement-lab.org"]; ok {
+			t.Errorf("checkAndReboot() rebooted a node while paused: %v", h)
+		}
+		if len(c.Candidates()) != 1 {
+			t.Errorf("checkAndReboot() did not record the candidates while paused: %v",
+				c.Candidates())
+		}
+	})
+}
+
+func Test_controller_Reboot(t *testing.T) {
+	eventLog = history.NewEventLog(testEventLog, 0, 0)
+	defer func() { eventLog = nil }()
+	defer removeFiles(testHistoryPath, testEventLog)
+	oldHistoryPath := historyPath
+	historyPath = testHistoryPath
+	defer func() { historyPath = oldHistoryPath }()
+
+	n := node.New("mlab1.lga0t.measurement-lab.org", "lga0t")
+	h := map[string]node.History{}
+	c := newController(h, &MockRebooter{})
+
+	hist, err := c.Reboot(n, false, "alice")
+	if err != nil || hist.Name != n.Name || hist.LastReboot.IsZero() {
+		t.Fatalf("Reboot() = %v, %v", hist, err)
 	}
 
-	// Nodes where no previous reboot was present
-	noHistory := []node.Node{
-		node.New("mlab2.iad1t.measurement-lab.org", "iad1t"),
+	// Another machine of the site is not rebooted while the first one is
+	// recovering.
+	other := node.New("mlab2.lga0t.measurement-lab.org", "lga0t")
+	_, err = c.Reboot(other, false, "alice")
+	if refused, ok := err.(*admin.RefusedError); !ok ||
+		!strings.Contains(refused.Reason, string(history.LimitSequence)) {
+		t.Errorf("Reboot() of another machine of the site = %v, want refused", err)
+	}
+
+	// A second reboot is refused by the cooldown, unless forced.
+	_, err = c.Reboot(n, false, "alice")
+	if _, ok := err.(*admin.RefusedError); !ok {
+		t.Errorf("Reboot() error = %v, want *admin.RefusedError", err)
+	}
+	hist, err = c.Reboot(n, true, "alice")
+	if err != nil || hist.Attempts != 2 {
+		t.Errorf("Reboot() with force = %v, %v", hist, err)
 	}
 
-	// Nodes where LastReboot is before 24hrs ago.
-	rebootable := []node.Node{
-		node.New("mlab2.iad0t.measurement-lab.org", "iad0t"),
+	events, err := history.ReadEvents(testEventLog, history.Query{})
+	rtx.Must(err, "Cannot read the event log")
+	var audit []string
+	for _, e := range events {
+		if e.Type == history.EventManualReboot {
+			audit = append(audit, e.Reason)
+		}
+	}
+	if len(audit) != 2 || !strings.Contains(audit[1], "forced") {
+		t.Errorf("Reboot() recorded the audit events %v", audit)
+	}
+
+	saved, err := history.Read(testHistoryPath)
+	if err != nil || saved[n.Name].Attempts != 2 {
+		t.Errorf("Reboot() did not write the history: %v, %v", saved, err)
+	}
+
+	c = newController(map[string]node.History{}, &MockRebooter{
+		fail: map[string]bool{n.Name: true},
+	})
+	hist, err = c.Reboot(n, false, "alice")
+	if err == nil || hist.Status != node.RebootFailed {
+		t.Errorf("Reboot() of a failing node = %v, %v", hist, err)
+	}
+}
+
+func Test_controller_Clear(t *testing.T) {
+	defer os.Remove(testHistoryPath)
+	oldHistoryPath := historyPath
+	historyPath = testHistoryPath
+	defer func() { historyPath = oldHistoryPath }()
+
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		rw.Write([]byte(`{"number": 7}`))
+	}))
+	defer srv.Close()
+	tickets = ticket.NewTracker(
+		ticket.NewClient(http.DefaultClient, srv.URL, "m-lab/ops", "token"),
+		2, nil, nil)
+	defer func() { tickets = nil }()
+
+	hist := node.NewHistory("mlab1.iad0t.measurement-lab.org", "iad0t", time.Now())
+	hist.Issue = 7
+	c := newController(map[string]node.History{hist.Name: hist}, &MockRebooter{})
+	if !c.Clear(hist.Name) || c.Clear(hist.Name) {
+		t.Fatalf("Clear() did not clear the node once")
 	}
 
-	// Nodes where LastReboot is within the last 24hrs.
-	notRebootable := []node.Node{
-		node.New("mlab1.iad0t.measurement-lab.org", "iad0t"),
-		node.New("mlab1.iad1t.measurement-lab.org", "iad1t"),
+	want := []string{"POST /repos/m-lab/ops/issues/7/comments",
+		"PATCH /repos/m-lab/ops/issues/7"}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("Clear() sent %v, want %v", requests, want)
 	}
+}
+
+// pausingProm is a PromClient pausing the controller on the first query,
+// i.e. while a check is running.
+type pausingProm struct {
+	promtest.PromClient
+	c *controller
+}
+
+func (p pausingProm) Query(ctx context.Context, q string, t time.Time) (model.Value, v1.Warnings, error) {
+	p.c.Pause()
+	return p.PromClient.Query(ctx, q, t)
+}
+
+func Test_controller_state(t *testing.T) {
+	defer os.Remove(testHistoryPath)
+	oldHistoryPath := historyPath
+	historyPath = testHistoryPath
+	defer func() { historyPath = oldHistoryPath }()
+
+	h := map[string]node.History{}
+	c := newController(h, &MockRebooter{})
+
+	// Reading the state and pausing do not wait for the running check.
+	c.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Candidates()
+		c.History()
+		c.Pause()
+		c.Resume()
+		c.Paused()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("The controller's accessors waited for the running check")
+	}
+	c.mu.Unlock()
+	<-done
+
+	// Reboots paused during a check are not sent.
+	oldProm := prom
+	prom = pausingProm{PromClient: fakeProm, c: c}
+	defer func() { prom = oldProm }()
+	c.run()
+	if len(h) != 0 || len(c.Candidates()) != 1 {
+		t.Errorf("run() rebooted nodes paused during the check: %v", h)
+	}
+
+	// The history is visible once the check completes.
+	c.Resume()
+	prom = fakeProm
+	c.run()
+	if _, ok := c.History()["mlab1.iad0t.measurement-lab.org"]; !ok {
+		t.Errorf("History() = %v, want the rebooted node", c.History())
+	}
+}
+
+func Test_controller_Stop(t *testing.T) {
+	defer removeFiles(testHistoryPath)
+	oldHistoryPath := historyPath
+	historyPath = testHistoryPath
+	defer func() { historyPath = oldHistoryPath }()
+
+	oldStopGrace := stopGrace
+	stopGrace = 100 * time.Millisecond
+	defer func() { stopGrace = oldStopGrace }()
+
+	h := map[string]node.History{}
+	c := newController(h, &MockRebooter{})
+
+	// A check is running: Stop waits for it until the deadline.
+	c.mu.Lock()
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer shortCancel()
+	if err := c.Stop(shortCtx); err != context.DeadlineExceeded {
+		t.Errorf("Stop() during a check = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if c.ctx.Err() != context.Canceled {
+		t.Errorf("Stop() did not cancel the running check")
+	}
+	c.mu.Unlock()
+
+	// Wait for the first Stop to complete before the test restores
+	// historyPath.
+	for stopped := false; !stopped; {
+		c.mu.Lock()
+		stopped = c.stopped
+		c.mu.Unlock()
+	}
+
+	if err := c.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if _, err := os.Stat(testHistoryPath); err != nil {
+		t.Errorf("Stop() did not write the history: %v", err)
+	}
+
+	// No check or reboot happens after Stop.
+	c.run()
+	_, err := c.Reboot(node.New("mlab1.lga0t.measurement-lab.org", "lga0t"), true, "alice")
+	if len(h) != 0 || err == nil {
+		t.Errorf("The stopped controller rebooted nodes: %v, %v", h, err)
+	}
+}
+
+func Test_controller_Stop_cancelled(t *testing.T) {
+	defer removeFiles(testHistoryPath)
+	oldHistoryPath := historyPath
+	historyPath = testHistoryPath
+	defer func() { historyPath = oldHistoryPath }()
+
+	// The reboot requests are sent, but not answered before the deadline.
+	called := make(chan struct{}, 1)
+	c := newController(map[string]node.History{}, &MockRebooter{
+		called: called,
+		slow:   true,
+	})
+	go c.run()
+	<-called
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.Stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Stop() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The cancelled check recorded the reboots before Stop returned.
+	saved, err := history.Read(testHistoryPath)
+	if _, ok := saved["mlab1.iad0t.measurement-lab.org"]; err != nil || !ok {
+		t.Errorf("Stop() did not write the rebooted nodes: %v, %v", saved, err)
+	}
+}
+
+func Test_rebootCommand(t *testing.T) {
+	defer removeFiles(testHistoryPath)
+	oldHistoryPath := historyPath
+	historyPath = testHistoryPath
+	defer func() { historyPath = oldHistoryPath }()
+
+	c := newController(map[string]node.History{}, &MockRebooter{})
+	srv := httptest.NewServer(admin.NewHandler(c, "", ""))
+	defer srv.Close()
+	oldAdminAddr := adminAddr
+	adminAddr = srv.URL
+	defer func() { adminAddr = oldAdminAddr }()
+
+	out := &bytes.Buffer{}
+	commandOutput = out
+	defer func() { commandOutput = os.Stdout }()
+
 	tests := []struct {
-		name             string
-		candidates       []node.Node
-		candidateHistory map[string]node.History
-		want             []node.Node
+		name    string
+		args    []string
+		wantErr bool
 	}{
 		{
-			name:             "success-no-history",
-			candidates:       noHistory,
-			candidateHistory: h,
-			want:             noHistory,
+			name: "success",
+			args: []string{"reboot", "mlab1.lga0t"},
+		},
+		{
+			name:    "refused",
+			args:    []string{"reboot", "mlab1.lga0t"},
+			wantErr: true,
+		},
+		{
+			name: "forced",
+			args: []string{"reboot", "mlab1.lga0t", "--force"},
 		},
 		{
-			name:             "success-rebootable",
-			candidates:       rebootable,
-			candidateHistory: h,
-			want:             rebootable,
+			name:    "invalid-machine",
+			args:    []string{"reboot", "-force", "lga0t"},
+			wantErr: true,
 		},
 		{
-			name:             "success-not-rebootable",
-			candidates:       notRebootable,
-			candidateHistory: h,
-			want:             []node.Node{},
+			name:    "missing-machine",
+			args:    []string{"reboot"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown-command",
+			args:    []string{"shutdown"},
+			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := filterRecent(tt.candidates, tt.candidateHistory); !(len(got) == 0 && len(tt.want) == 0) && !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("filterRecent() = %v, want %v", got, tt.want)
+			if err := runCommand(tt.args); (err != nil) != tt.wantErr {
+				t.Errorf("runCommand() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
+
+	if !strings.Contains(out.String(), "mlab1.lga0t.measurement-lab.org") {
+		t.Errorf("runCommand() output = %q", out.String())
+	}
+	if c.History()["mlab1.lga0t.measurement-lab.org"].Attempts != 2 {
+		t.Errorf("runCommand() did not update the history: %v", c.History())
+	}
+}
+
+func Test_silenceCommands(t *testing.T) {
+	var err error
+	silences, err = history.ReadSilences(testSilencesPath)
+	rtx.Must(err, "Cannot read silences")
+	defer func() { silences = nil }()
+	defer removeFiles(testSilencesPath)
+
+	c := newController(map[string]node.History{}, &MockRebooter{})
+	srv := httptest.NewServer(admin.NewHandler(c, "", ""))
+	defer srv.Close()
+	oldAdminAddr := adminAddr
+	adminAddr = srv.URL
+	defer func() { adminAddr = oldAdminAddr }()
+
+	out := &bytes.Buffer{}
+	commandOutput = out
+	defer func() { commandOutput = os.Stdout }()
+
+	err = runCommand([]string{"silence", "-site", "lga.*", "-duration", "1h",
+		"-comment", "flaky"})
+	if err != nil {
+		t.Fatalf("runCommand(silence) error = %v", err)
+	}
+	added := c.Silences()
+	if len(added) != 1 || added[0].Site != "lga.*" || added[0].Comment != "flaky" {
+		t.Fatalf("runCommand(silence) added %v", added)
+	}
+
+	// The silence also applies to manual reboots.
+	_, err = c.Reboot(node.New("mlab1.lga0t.measurement-lab.org", "lga0t"), false, "bob")
+	if _, ok := err.(*admin.RefusedError); !ok {
+		t.Errorf("Reboot() of a silenced node error = %v", err)
+	}
+
+	err = runCommand([]string{"silence", "-label", "module=ssh_v4_online",
+		"-label", "service=ssh806"})
+	if err != nil {
+		t.Fatalf("runCommand(silence) error = %v", err)
+	}
+	if len(c.Silences()) != 2 || len(c.Silences()[1].Labels) != 2 {
+		t.Fatalf("runCommand(silence) added %v", c.Silences())
+	}
+
+	out.Reset()
+	if err = runCommand([]string{"silences"}); err != nil ||
+		!strings.Contains(out.String(), added[0].ID) {
+		t.Errorf("runCommand(silences) = %q, %v", out.String(), err)
+	}
+
+	if err = runCommand([]string{"unsilence", added[0].ID}); err != nil {
+		t.Errorf("runCommand(unsilence) error = %v", err)
+	}
+	if len(c.Silences()) != 1 {
+		t.Errorf("runCommand(unsilence) did not remove the silence")
+	}
+
+	for _, args := range [][]string{
+		{"silence", "-label", "invalid"},
+		{"silence", "-duration", "1h", "extra"},
+		{"silence", "-duration", "1h"},
+		{"silences", "extra"},
+		{"unsilence"},
+	} {
+		if err = runCommand(args); err == nil {
+			t.Errorf("runCommand(%v) did not fail", args)
+		}
+	}
 }
 
 func Test_main_oneshot(t *testing.T) {
+	defer saveGlobals()()
 	restore := osx.MustSetenv("ONESHOT", "1")
 	defer restore()
+	restoreHistory := osx.MustSetenv("HISTORYPATH", testHistoryPath)
+	defer restoreHistory()
+	restoreEvents := osx.MustSetenv("EVENTLOG", testEventLog)
+	defer restoreEvents()
+	defer removeFiles(testHistoryPath, testEventLog)
 
 	ctx, cancel = context.WithCancel(context.Background())
 	listenAddr = ":9000"
@@ -158,8 +788,15 @@ func Test_main_oneshot(t *testing.T) {
 }
 
 func Test_main_multi(t *testing.T) {
+	defer saveGlobals()()
 	restore := osx.MustSetenv("ONESHOT", "0")
 	defer restore()
+	restoreHistory := osx.MustSetenv("HISTORYPATH", testHistoryPath)
+	defer restoreHistory()
+	restoreEvents := osx.MustSetenv("EVENTLOG", testEventLog)
+	defer restoreEvents()
+	defer os.Remove(testHistoryPath)
+	defer os.Remove(testEventLog)
 
 	ctx, cancel = context.WithCancel(context.Background())
 	listenAddr = ":9001"
@@ -178,7 +815,87 @@ func Test_main_multi(t *testing.T) {
 	newRebooter = oldNewRebooterFunc
 }
 
+func Test_main_sigterm(t *testing.T) {
+	defer saveGlobals()()
+	restore := osx.MustSetenv("ONESHOT", "0")
+	defer restore()
+	restoreHistory := osx.MustSetenv("HISTORYPATH", testHistoryPath)
+	defer restoreHistory()
+	restoreEvents := osx.MustSetenv("EVENTLOG", testEventLog)
+	defer restoreEvents()
+	defer removeFiles(testHistoryPath, testEventLog)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	listenAddr = ":9002"
+
+	// SIGTERM is sent during the first check, once main handles it: sent
+	// earlier, it would kill the test binary.
+	ready := make(chan struct{})
+	oldNotifySignals := notifySignals
+	notifySignals = func(c chan<- os.Signal) {
+		oldNotifySignals(c)
+		close(ready)
+	}
+	defer func() { notifySignals = oldNotifySignals }()
+	called := make(chan struct{}, 1)
+	go func() {
+		<-ready
+		<-called
+		rtx.Must(syscall.Kill(os.Getpid(), syscall.SIGTERM), "Cannot send SIGTERM")
+	}()
+
+	oldNewRebooterFunc := newRebooter
+	newRebooter = func(c *http.Client, baseURL, user, pass string) Rebooter {
+		return &MockRebooter{called: called}
+	}
+	main()
+	newRebooter = oldNewRebooterFunc
+
+	// The history of the reboots is written before main returns.
+	saved, err := history.Read(testHistoryPath)
+	if err != nil || len(saved) == 0 {
+		t.Errorf("main() did not write the history on SIGTERM: %v, %v", saved, err)
+	}
+}
+
+func Test_newRebooter(t *testing.T) {
+	f, err := ioutil.TempFile("", "redfish")
+	rtx.Must(err, "Cannot create the credentials file")
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"default": {"username": "root", "password": "calvin"}}`)
+	rtx.Must(err, "Cannot write the credentials file")
+	f.Close()
+
+	oldBackend, oldCredentials := rebootBackend, redfishCredentials
+	defer func() { rebootBackend, redfishCredentials = oldBackend, oldCredentials }()
+
+	rebootBackend = "api"
+	if _, ok := newRebooter(http.DefaultClient, "", "", "").(*reboot.HTTPRebooter); !ok {
+		t.Errorf("newRebooter() did not return an HTTPRebooter for the api backend")
+	}
+	rebootBackend, redfishCredentials, redfishInsecure = "redfish", f.Name(), true
+	defer func() { redfishInsecure = false }()
+	if _, ok := newRebooter(http.DefaultClient, "", "", "").(*reboot.RedfishRebooter); !ok {
+		t.Errorf("newRebooter() did not return a RedfishRebooter for the redfish backend")
+	}
+}
+
+func Test_insecureTransport(t *testing.T) {
+	got := insecureTransport()
+	want := http.DefaultTransport.(*http.Transport)
+	if got.DialContext == nil || got.TLSHandshakeTimeout != want.TLSHandshakeTimeout ||
+		got.IdleConnTimeout != want.IdleConnTimeout || got.MaxIdleConns != want.MaxIdleConns {
+		t.Errorf("insecureTransport() does not have the default settings: %+v", got)
+	}
+	if !got.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("insecureTransport() verifies certificates")
+	}
+}
+
 func TestMetrics(t *testing.T) {
 	metricLastRebootTs.WithLabelValues("x", "x")
+	metricCriterionMatches.WithLabelValues("x", "x")
+	metricRecoveryTime.WithLabelValues("x")
+	metricOverBudget.WithLabelValues("x")
 	promlint.LintMetrics(t)
 }
@@ -1,9 +1,19 @@
 package node
 
 import (
+	"fmt"
+	"regexp"
 	"time"
 )
 
+// Domain is the domain of M-Lab's machines.
+const Domain = "measurement-lab.org"
+
+// machineRegex matches a machine name, either fully qualified or not, e.g.
+// mlab1.lga0t.measurement-lab.org or mlab1.lga0t.
+var machineRegex = regexp.MustCompile(
+	`^mlab[1-4]\.([a-z]{3}[0-9][0-9t])(\.` + regexp.QuoteMeta(Domain) + `)?$`)
+
 // NodeStatus is an alias for uint8, used for readability.
 type NodeStatus uint8
 
@@ -18,6 +28,9 @@ const (
 	// ObservedOffline means the machine is still seen as offline after a
 	// reboot command.
 	ObservedOffline = NodeStatus(2)
+
+	// RebootFailed means the last reboot request for the machine failed.
+	RebootFailed = NodeStatus(3)
 )
 
 // Node represents a machine on M-Lab's infrastructure
@@ -26,14 +39,59 @@ type Node struct {
 	Site string
 }
 
+// Verdict is the outcome of the health check for a Node. Reasons contains
+// the names of the criteria that selected the Node for reboot, Exclusions
+// the names of the criteria that prevent it from being rebooted. Labels
+// holds the labels of the samples that selected the Node.
+type Verdict struct {
+	Node
+	Reasons    []string
+	Exclusions []string
+	Labels     map[string]string
+}
+
 // History holds the last reboot of a Node and the status.
 //
 // Status is always NotObserved initially, and should be updated to
 // ObservedOnline or ObservedOffline as soon as the information is available.
+// Reasons holds the criteria that caused the last reboot.
+//
+// If the last reboot request failed, Status is RebootFailed, LastAttempt is
+// the time of the failed request and Error its error message, while
+// LastReboot still refers to the last successful reboot, if any.
+//
+// Attempts is the number of consecutive reboots that did not bring the node
+// back online. NeedsHuman is set once Attempts reaches the maximum allowed,
+// and the node is not rebooted anymore until an operator clears it.
+//
+// Recovered is the time the node was first observed online after the last
+// reboot, and Checks the number of checks since the last reboot up to and
+// including that observation.
+//
+// Issue is the number of the open issue tracking the node, if any.
 type History struct {
 	Node
-	LastReboot time.Time
-	Status     NodeStatus
+	LastReboot  time.Time
+	Status      NodeStatus
+	Reasons     []string
+	LastAttempt time.Time
+	Error       string
+	Attempts    int
+	NeedsHuman  bool
+	Recovered   time.Time
+	Checks      int
+	Issue       int
+}
+
+// RecoveryTime returns how long the node took to come back online after the
+// last reboot, or zero if it has not been observed online yet or if the
+// last reboot request failed.
+func (h History) RecoveryTime() time.Duration {
+	if h.Status != ObservedOnline || h.Recovered.IsZero() ||
+		h.LastReboot.IsZero() || h.LastAttempt.After(h.LastReboot) {
+		return 0
+	}
+	return h.Recovered.Sub(h.LastReboot)
 }
 
 // New returns a new Node
@@ -44,11 +102,59 @@ func New(name string, site string) Node {
 	}
 }
 
+// Metro returns the metro the node's site is in, i.e. the site name
+// without the trailing site number (e.g. "lga" for "lga0t").
+func (n Node) Metro() string {
+	if len(n.Site) < 3 {
+		return n.Site
+	}
+	return n.Site[:3]
+}
+
+// Parse validates a machine name and returns the corresponding Node, with
+// the fully qualified name and the site extracted from it.
+func Parse(name string) (Node, error) {
+	m := machineRegex.FindStringSubmatch(name)
+	if m == nil {
+		return Node{}, fmt.Errorf("invalid machine name: %q", name)
+	}
+	if m[2] == "" {
+		name = name + "." + Domain
+	}
+	return New(name, m[1]), nil
+}
+
+// Excluded returns true if any exclusion applies to the Node.
+func (v Verdict) Excluded() bool {
+	return len(v.Exclusions) != 0
+}
+
+// Candidates returns the verdicts to which no exclusion applies.
+func Candidates(verdicts []Verdict) []Verdict {
+	candidates := make([]Verdict, 0)
+	for _, v := range verdicts {
+		if !v.Excluded() {
+			candidates = append(candidates, v)
+		}
+	}
+	return candidates
+}
+
+// Nodes returns the Node of every verdict.
+func Nodes(verdicts []Verdict) []Node {
+	nodes := make([]Node, 0, len(verdicts))
+	for _, v := range verdicts {
+		nodes = append(nodes, v.Node)
+	}
+	return nodes
+}
+
 // NewHistory returns a new NodeHistory, defaulting Status to "NotObserved".
 func NewHistory(name string, site string, lastReboot time.Time) History {
 	return History{
-		New(name, site),
-		lastReboot,
-		NotObserved,
+		Node:        New(name, site),
+		LastReboot:  lastReboot,
+		Status:      NotObserved,
+		LastAttempt: lastReboot,
 	}
 }
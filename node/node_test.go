@@ -0,0 +1,65 @@
+package node
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Node
+		wantErr bool
+	}{
+		{
+			name: "mlab1.lga0t.measurement-lab.org",
+			want: New("mlab1.lga0t.measurement-lab.org", "lga0t"),
+		},
+		{
+			name: "mlab4.iad01",
+			want: New("mlab4.iad01.measurement-lab.org", "iad01"),
+		},
+		{
+			name:    "mlab5.lga0t",
+			wantErr: true,
+		},
+		{
+			name:    "mlab1.lga0t.example.org",
+			wantErr: true,
+		},
+		{
+			name:    "",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNode_Metro(t *testing.T) {
+	tests := []struct {
+		site string
+		want string
+	}{
+		{site: "lga0t", want: "lga"},
+		{site: "iad01", want: "iad"},
+		{site: "x", want: "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.site, func(t *testing.T) {
+			if got := New("mlab1."+tt.site, tt.site).Metro(); got != tt.want {
+				t.Errorf("Node.Metro() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
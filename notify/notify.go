@@ -0,0 +1,174 @@
+// Package notify sends notifications to humans when rebot cannot fix
+// things on its own.
+package notify
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kind is the kind of condition a Notification is about.
+type Kind string
+
+const (
+	// BudgetExhausted is sent when a safety limit of the reboot budget
+	// prevents rebooting some of the offline nodes.
+	BudgetExhausted = Kind("budget-exhausted")
+
+	// RebootFailed is sent when a reboot request fails.
+	RebootFailed = Kind("reboot-failed")
+
+	// GaveUp is sent when a node did not recover after the maximum number
+	// of reboots.
+	GaveUp = Kind("gave-up")
+
+	// HistoryCorrupted is sent when the history file cannot be read.
+	HistoryCorrupted = Kind("history-corrupted")
+)
+
+var (
+	metricNotifications = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rebot_notifications_total",
+			Help: "Total number of notifications by kind and status.",
+		},
+		[]string{
+			"kind",
+			"status",
+		},
+	)
+)
+
+// sendTimeout is how long Notify waits for each sink, so that an
+// unresponsive sink does not block the caller. It can be swapped to simplify
+// unit testing.
+var sendTimeout = 10 * time.Second
+
+// Notification describes a condition needing a human. Key identifies the
+// instance of the condition (e.g. the machine) for deduplication.
+type Notification struct {
+	Time     time.Time `json:"time"`
+	Kind     Kind      `json:"kind"`
+	Key      string    `json:"key,omitempty"`
+	Summary  string    `json:"summary"`
+	Machines []string  `json:"machines,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Sink delivers notifications.
+type Sink interface {
+	Send(n Notification) error
+}
+
+// Notifier sends notifications to every sink, suppressing those with the
+// same kind and key as one delivered by at least one sink less than interval
+// ago.
+type Notifier struct {
+	sinks    []Sink
+	interval time.Duration
+	sent     map[string]time.Time
+
+	mu sync.Mutex
+}
+
+// New returns a Notifier sending to the given sinks.
+func New(interval time.Duration, sinks ...Sink) *Notifier {
+	return &Notifier{
+		sinks:    sinks,
+		interval: interval,
+		sent:     map[string]time.Time{},
+	}
+}
+
+// Notify sends the notification to every sink, unless it's a duplicate.
+// Errors are logged, and if no sink delivers the notification it is not
+// considered sent. The Time field is set if empty. Notifying with a nil
+// Notifier is a no-op.
+func (n *Notifier) Notify(notif Notification) {
+	if n == nil {
+		return
+	}
+	if notif.Time.IsZero() {
+		notif.Time = time.Now()
+	}
+	key := dedupKey(notif.Kind, notif.Key)
+
+	// The key is recorded before sending, so that concurrent duplicates are
+	// suppressed, and the sinks are called without holding the lock.
+	n.mu.Lock()
+	if last, ok := n.sent[key]; ok && notif.Time.Sub(last) < n.interval {
+		n.mu.Unlock()
+		log.WithFields(log.Fields{"kind": notif.Kind, "key": notif.Key}).Debug("Suppressing duplicate notification.")
+		metricNotifications.WithLabelValues(string(notif.Kind), "suppressed").Inc()
+		return
+	}
+	n.sent[key] = notif.Time
+	n.mu.Unlock()
+
+	log.WithFields(log.Fields{"kind": notif.Kind, "key": notif.Key}).Warn(notif.Summary)
+	if len(n.sinks) == 0 || n.send(notif) {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if last, ok := n.sent[key]; ok && last.Equal(notif.Time) {
+		delete(n.sent, key)
+	}
+}
+
+// send sends the notification to every sink concurrently, waiting at most
+// sendTimeout. It returns true if at least one sink delivered it.
+func (n *Notifier) send(notif Notification) bool {
+	results := make(chan error, len(n.sinks))
+	for _, s := range n.sinks {
+		go func(s Sink) {
+			results <- s.Send(notif)
+		}(s)
+	}
+
+	timeout := time.NewTimer(sendTimeout)
+	defer timeout.Stop()
+
+	delivered := false
+	for i := range n.sinks {
+		select {
+		case err := <-results:
+			if err != nil {
+				log.WithError(err).WithField("kind", notif.Kind).Error("Cannot send notification.")
+				metricNotifications.WithLabelValues(string(notif.Kind), "failure").Inc()
+				continue
+			}
+			metricNotifications.WithLabelValues(string(notif.Kind), "success").Inc()
+			delivered = true
+		case <-timeout.C:
+			log.WithFields(log.Fields{"kind": notif.Kind, "sinks": len(n.sinks) - i}).Error(
+				"Timed out sending notification.")
+			metricNotifications.WithLabelValues(string(notif.Kind), "failure").Add(
+				float64(len(n.sinks) - i))
+			return delivered
+		}
+	}
+	return delivered
+}
+
+// Resolve marks the condition identified by kind and key as cleared, so
+// that the next notification for it is sent right away.
+func (n *Notifier) Resolve(kind Kind, key string) {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.sent, dedupKey(kind, key))
+}
+
+func dedupKey(kind Kind, key string) string {
+	return string(kind) + "/" + key
+}
@@ -0,0 +1,230 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	"github.com/m-lab/go/rtx"
+)
+
+// fakeSink records the notifications it receives.
+type fakeSink struct {
+	sent []Notification
+	err  error
+}
+
+func (s *fakeSink) Send(n Notification) error {
+	s.sent = append(s.sent, n)
+	return s.err
+}
+
+func TestNotifier(t *testing.T) {
+	sink := &fakeSink{}
+	failing := &fakeSink{err: errors.New("cannot send")}
+	n := New(time.Hour, sink, failing)
+
+	now := time.Now()
+	failed := Notification{Time: now, Kind: RebootFailed, Key: "mlab1"}
+	n.Notify(failed)
+	n.Notify(Notification{Kind: RebootFailed, Key: "mlab2"})
+	if len(sink.sent) != 2 || len(failing.sent) != 2 {
+		t.Fatalf("Notify() sent %v, want 2 notifications", sink.sent)
+	}
+	if sink.sent[1].Time.IsZero() {
+		t.Errorf("Notify() did not set the time")
+	}
+
+	// The same condition is not notified again within the interval.
+	failed.Time = now.Add(time.Minute)
+	n.Notify(failed)
+	if len(sink.sent) != 2 {
+		t.Errorf("Notify() sent a duplicate notification: %v", sink.sent)
+	}
+
+	// ...unless it's resolved in the meantime.
+	n.Resolve(RebootFailed, "mlab1")
+	n.Notify(failed)
+	if len(sink.sent) != 3 {
+		t.Errorf("Notify() did not send after Resolve(): %v", sink.sent)
+	}
+
+	// ...or the interval elapsed.
+	failed.Time = now.Add(2 * time.Hour)
+	n.Notify(failed)
+	if len(sink.sent) != 4 {
+		t.Errorf("Notify() did not send after the interval: %v", sink.sent)
+	}
+
+	// A notification no sink delivered is not suppressed.
+	failing = &fakeSink{err: errors.New("cannot send")}
+	n = New(time.Hour, failing)
+	n.Notify(failed)
+	n.Notify(failed)
+	if len(failing.sent) != 2 {
+		t.Errorf("Notify() suppressed an undelivered notification: %v", failing.sent)
+	}
+
+	// A nil Notifier does nothing.
+	var nilNotifier *Notifier
+	nilNotifier.Notify(failed)
+	nilNotifier.Resolve(RebootFailed, "mlab1")
+}
+
+// blockingSink never returns until unblocked.
+type blockingSink struct {
+	unblock chan struct{}
+}
+
+func (s *blockingSink) Send(n Notification) error {
+	<-s.unblock
+	return nil
+}
+
+func TestNotifier_timeout(t *testing.T) {
+	oldTimeout := sendTimeout
+	sendTimeout = 50 * time.Millisecond
+	defer func() { sendTimeout = oldTimeout }()
+
+	blocking := &blockingSink{unblock: make(chan struct{})}
+	defer close(blocking.unblock)
+	sink := &fakeSink{}
+	n := New(time.Hour, blocking, sink)
+
+	start := time.Now()
+	n.Notify(Notification{Kind: GaveUp, Key: "mlab1"})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Notify() blocked for %v on an unresponsive sink", elapsed)
+	}
+	if len(sink.sent) != 1 {
+		t.Errorf("Notify() did not send to the other sink: %v", sink.sent)
+	}
+
+	// The notification was delivered by one sink: it's suppressed.
+	n.Notify(Notification{Kind: GaveUp, Key: "mlab1"})
+	if len(sink.sent) != 1 {
+		t.Errorf("Notify() sent a duplicate notification: %v", sink.sent)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var got Notification
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost ||
+			req.Header.Get("Content-Type") != "application/json" {
+			http.Error(rw, "bad request", http.StatusBadRequest)
+			return
+		}
+		rtx.Must(json.NewDecoder(req.Body).Decode(&got), "Cannot decode body")
+		if got.Key == "fail" {
+			http.Error(rw, "internal error", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	s := NewWebhookSink(http.DefaultClient, srv.URL)
+	err := s.Send(Notification{Kind: GaveUp, Key: "mlab1", Summary: "gave up"})
+	if err != nil || got.Kind != GaveUp || got.Key != "mlab1" {
+		t.Errorf("WebhookSink.Send() = %v, sent %v", err, got)
+	}
+
+	err = s.Send(Notification{Kind: GaveUp, Key: "fail"})
+	if err == nil {
+		t.Errorf("WebhookSink.Send() did not fail on a 500 response")
+	}
+
+	s = NewWebhookSink(http.DefaultClient, "http://invalid.invalid:-1")
+	if err = s.Send(Notification{}); err == nil {
+		t.Errorf("WebhookSink.Send() to an invalid URL did not fail")
+	}
+}
+
+func TestSMTPSink(t *testing.T) {
+	var gotAddr, gotFrom string
+	var gotTo []string
+	var gotAuth smtp.Auth
+	var gotMsg []byte
+	oldSendMail := sendMail
+	sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		gotAddr, gotAuth, gotFrom, gotTo, gotMsg = addr, a, from, to, msg
+		return nil
+	}
+	defer func() { sendMail = oldSendMail }()
+
+	s := NewSMTPSink("smtp.example.org:587", "rebot@example.org",
+		[]string{"ops@example.org", "oncall@example.org"}, "user", "pass")
+	err := s.Send(Notification{
+		Time:     time.Now(),
+		Kind:     RebootFailed,
+		Summary:  "Reboot failed",
+		Machines: []string{"mlab1.lga0t.measurement-lab.org"},
+		Error:    "i/o error",
+	})
+	if err != nil {
+		t.Fatalf("SMTPSink.Send() error = %v", err)
+	}
+	if gotAddr != "smtp.example.org:587" || gotFrom != "rebot@example.org" ||
+		len(gotTo) != 2 || gotAuth == nil {
+		t.Errorf("SMTPSink.Send() sent to %s from %s to %v", gotAddr, gotFrom, gotTo)
+	}
+	for _, want := range []string{"Subject: [rebot] Reboot failed",
+		"To: ops@example.org, oncall@example.org",
+		"Machines: mlab1.lga0t.measurement-lab.org", "Error: i/o error"} {
+		if !strings.Contains(string(gotMsg), want) {
+			t.Errorf("SMTPSink.Send() message does not contain %q:\n%s", want, gotMsg)
+		}
+	}
+
+	s = NewSMTPSink("invalid", "rebot@example.org", nil, "user", "pass")
+	if err = s.Send(Notification{}); err == nil {
+		t.Errorf("SMTPSink.Send() with an invalid address did not fail")
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify")
+	rtx.Must(err, "Cannot create temporary directory")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notifications.jsonl")
+	s := NewFileSink(path)
+	for _, kind := range []Kind{BudgetExhausted, HistoryCorrupted} {
+		if err = s.Send(Notification{Kind: kind}); err != nil {
+			t.Fatalf("FileSink.Send() error = %v", err)
+		}
+	}
+
+	f, err := os.Open(path)
+	rtx.Must(err, "Cannot open notifications file")
+	defer f.Close()
+	var kinds []Kind
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var n Notification
+		rtx.Must(json.Unmarshal(scanner.Bytes(), &n), "Cannot decode notification")
+		kinds = append(kinds, n.Kind)
+	}
+	if len(kinds) != 2 || kinds[0] != BudgetExhausted || kinds[1] != HistoryCorrupted {
+		t.Errorf("FileSink.Send() wrote %v", kinds)
+	}
+
+	s = NewFileSink(filepath.Join(dir, "notfound", "notifications.jsonl"))
+	if err = s.Send(Notification{}); err == nil {
+		t.Errorf("FileSink.Send() to a missing directory did not fail")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metricNotifications.WithLabelValues("x", "x")
+	promtest.LintMetrics(t)
+}
@@ -0,0 +1,140 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This can be swapped to simplify unit testing.
+var sendMail = smtp.SendMail
+
+// WebhookSink sends notifications as JSON in the body of a POST request.
+type WebhookSink struct {
+	client *http.Client
+	url    string
+}
+
+// NewWebhookSink returns a WebhookSink sending to url.
+func NewWebhookSink(c *http.Client, url string) *WebhookSink {
+	return &WebhookSink{
+		client: c,
+		url:    url,
+	}
+}
+
+// Send posts the notification to the webhook. Any non-2xx status is an
+// error.
+func (s *WebhookSink) Send(n Notification) error {
+	content, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("webhook returned %s: %s", resp.Status,
+			strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// SMTPSink sends notifications by email.
+type SMTPSink struct {
+	addr     string
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+// NewSMTPSink returns a SMTPSink sending emails from one address to the
+// others via the SMTP server at addr ("host:port"). If username is not
+// empty, it authenticates with PLAIN authentication.
+func NewSMTPSink(addr, from string, to []string, username, password string) *SMTPSink {
+	return &SMTPSink{
+		addr:     addr,
+		from:     from,
+		to:       to,
+		username: username,
+		password: password,
+	}
+}
+
+// Send sends the notification by email, with the summary as the subject.
+func (s *SMTPSink) Send(n Notification) error {
+	var auth smtp.Auth
+	if s.username != "" {
+		host, _, err := net.SplitHostPort(s.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.username, s.password, host)
+	}
+
+	body := &bytes.Buffer{}
+	fmt.Fprintf(body, "From: %s\r\n", s.from)
+	fmt.Fprintf(body, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(body, "Subject: [rebot] %s\r\n", n.Summary)
+	fmt.Fprintf(body, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(body, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(body, "%s\r\n\r\n", n.Summary)
+	fmt.Fprintf(body, "Kind: %s\r\n", n.Kind)
+	if len(n.Machines) != 0 {
+		fmt.Fprintf(body, "Machines: %s\r\n", strings.Join(n.Machines, ", "))
+	}
+	if n.Error != "" {
+		fmt.Fprintf(body, "Error: %s\r\n", n.Error)
+	}
+
+	return sendMail(s.addr, auth, s.from, s.to, body.Bytes())
+}
+
+// FileSink appends notifications to a file as JSON lines. It's mostly
+// useful for testing.
+type FileSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileSink returns a FileSink writing to path.
+func NewFileSink(path string) *FileSink {
+	return &FileSink{
+		path: path,
+	}
+}
+
+// Send appends the notification to the file.
+func (s *FileSink) Send(n Notification) error {
+	content, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(content, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package reboot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// State is the state of a Breaker. Its value is exported as the
+// rebot_reboot_api_circuit_state metric.
+type State int
+
+const (
+	// Closed is the normal state: requests are sent.
+	Closed = State(0)
+
+	// Open means that the Reboot API is failing: requests are not sent.
+	Open = State(1)
+
+	// HalfOpen means that the cooldown has elapsed: a single probe request
+	// is sent to check whether the Reboot API is back.
+	HalfOpen = State(2)
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+var (
+	metricCircuitState = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rebot_reboot_api_circuit_state",
+			Help: "State of the circuit breaker around the Reboot API: 0 " +
+				"closed, 1 open (the API is failing), 2 half-open.",
+		},
+	)
+)
+
+// Breaker is a circuit breaker around the Reboot API. It opens after
+// threshold consecutive API-level failures (i.e. any error class but
+// Permanent), rejecting requests until cooldown has elapsed. Then it
+// half-opens and lets a single probe request through: if it succeeds the
+// breaker closes, otherwise it opens again.
+//
+// A reboot retried several times counts as a single failure. Context
+// errors, i.e. the caller giving up, are not failures.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewBreaker returns a closed Breaker. If threshold is less than 1, it
+// never opens.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	metricCircuitState.Set(float64(Closed))
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow returns nil if a request can be sent, or an *Error of class
+// CircuitOpen otherwise. Every allowed request must be followed by a call
+// to Record with its outcome.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Open && time.Since(b.openedAt) >= b.cooldown {
+		log.Info("Reboot API circuit half-open, probing.")
+		b.setState(HalfOpen)
+	}
+
+	switch {
+	case b.state == Closed:
+		return nil
+	case b.state == HalfOpen && !b.probing:
+		b.probing = true
+		return nil
+	}
+	return &Error{
+		Class: CircuitOpen,
+		Err: fmt.Errorf("%d consecutive Reboot API failures, not sending "+
+			"requests until %s", b.failures,
+			b.openedAt.Add(b.cooldown).Format(time.RFC3339)),
+	}
+}
+
+// Record records the outcome of a request allowed by Allow. A context
+// error is ignored: if the request was a probe, another one is allowed.
+func (b *Breaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	probe := b.state == HalfOpen && b.probing
+	if probe {
+		b.probing = false
+	}
+
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return
+	}
+
+	// Permanent errors come from the Reboot API working as intended.
+	if err == nil || ClassOf(err) == Permanent {
+		b.failures = 0
+		if probe {
+			log.Info("Reboot API circuit closed.")
+			b.setState(Closed)
+		}
+		return
+	}
+
+	b.failures++
+	if probe || (b.state == Closed && b.threshold > 0 && b.failures >= b.threshold) {
+		log.WithError(err).WithField("failures", b.failures).Error(
+			"Reboot API circuit open, not sending reboot requests.")
+		b.openedAt = time.Now()
+		b.setState(Open)
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// setState sets the state and the corresponding metric. The caller must
+// hold b.mu.
+func (b *Breaker) setState(s State) {
+	b.state = s
+	metricCircuitState.Set(float64(s))
+}
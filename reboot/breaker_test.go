@@ -0,0 +1,143 @@
+package reboot
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m-lab/rebot/node"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBreaker(t *testing.T) {
+	serverErr := &Error{Class: ServerError, Err: errors.New("bad gateway")}
+	notFound := &Error{Class: Permanent, Err: errors.New("host not found")}
+
+	b := NewBreaker(2, 20*time.Millisecond)
+	steps := []struct {
+		name      string
+		sleep     time.Duration
+		record    error
+		wantAllow bool
+		wantState State
+	}{
+		{name: "first-failure", record: serverErr, wantAllow: true, wantState: Closed},
+		{name: "host-error-resets", record: notFound, wantAllow: true, wantState: Closed},
+		{name: "failure", record: serverErr, wantAllow: true, wantState: Closed},
+		{name: "context-error-ignored", record: context.Canceled, wantAllow: true,
+			wantState: Closed},
+		{name: "threshold-opens", record: serverErr, wantAllow: true, wantState: Open},
+		{name: "open-rejects", wantAllow: false, wantState: Open},
+		{name: "failed-probe-reopens", sleep: 30 * time.Millisecond, record: serverErr,
+			wantAllow: true, wantState: Open},
+		{name: "reopened-rejects", wantAllow: false, wantState: Open},
+		{name: "probe-closes", sleep: 30 * time.Millisecond, record: nil,
+			wantAllow: true, wantState: Closed},
+	}
+	for _, s := range steps {
+		time.Sleep(s.sleep)
+		err := b.Allow()
+		if (err == nil) != s.wantAllow {
+			t.Fatalf("%s: Allow() = %v, want allowed = %v", s.name, err, s.wantAllow)
+		}
+		if err != nil {
+			if ClassOf(err) != CircuitOpen || Retryable(err) {
+				t.Errorf("%s: Allow() = %v, want a CircuitOpen error", s.name, err)
+			}
+		} else {
+			if s.wantState == Open && s.sleep > 0 && b.State() != HalfOpen {
+				t.Errorf("%s: State() = %v, want half-open", s.name, b.State())
+			}
+			b.Record(s.record)
+		}
+		if b.State() != s.wantState {
+			t.Errorf("%s: State() = %v, want %v", s.name, b.State(), s.wantState)
+		}
+		if got := testutil.ToFloat64(metricCircuitState); got != float64(s.wantState) {
+			t.Errorf("%s: rebot_reboot_api_circuit_state = %v, want %d", s.name, got, s.wantState)
+		}
+	}
+
+	// Only one probe is sent while half-open.
+	b.Allow()
+	b.Record(serverErr)
+	b.Allow()
+	b.Record(serverErr)
+	time.Sleep(30 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow() of the probe = %v", err)
+	}
+	if err := b.Allow(); err == nil {
+		t.Errorf("Allow() let a second probe through")
+	}
+
+	// A zero threshold disables the breaker.
+	b = NewBreaker(0, time.Hour)
+	for i := 0; i < 10; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("Allow() of a disabled breaker = %v", err)
+		}
+		b.Record(serverErr)
+	}
+}
+
+func TestHTTPRebooter_breaker(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+		http.Error(rw, "bad gateway", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	toReboot := []node.Node{}
+	for _, m := range []string{"mlab1", "mlab2", "mlab3", "mlab4"} {
+		toReboot = append(toReboot, node.New(m+".lga0t.measurement-lab.org", "lga0t"))
+	}
+	rebooter := NewHTTPRebooter(http.DefaultClient, srv.URL, "", "", Config{
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Hour,
+	})
+	got := rebooter.Many(context.Background(), toReboot)
+
+	if calls != 2 {
+		t.Errorf("Many() sent %d requests, want 2 before the circuit opens", calls)
+	}
+	for i, n := range toReboot {
+		want := ServerError
+		if i >= 2 {
+			want = CircuitOpen
+		}
+		if class := ClassOf(got.Failed[n.Name]); class != want {
+			t.Errorf("Many() failed %s with %v, want %v", n.Name, class, want)
+		}
+	}
+
+	// A reboot retried several times is a single failure.
+	unavailable := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	rebooter = NewHTTPRebooter(http.DefaultClient, unavailable.URL, "", "", Config{
+		Retries:          2,
+		Backoff:          time.Millisecond,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Hour,
+	})
+	rebooter.Many(context.Background(), toReboot[:1])
+	if rebooter.breaker.State() != Closed {
+		t.Errorf("Many() opened the breaker after a single retried reboot")
+	}
+
+	// Reboots cancelled by the caller are not failures.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	got = rebooter.Many(ctx, toReboot)
+	for _, n := range toReboot {
+		if class := ClassOf(got.Failed[n.Name]); class == CircuitOpen {
+			t.Errorf("Many() with a cancelled context opened the breaker")
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package reboot
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Class is the class of a reboot error. It's also the status label of the
+// reboot requests metric.
+type Class string
+
+const (
+	// Transient errors are transport failures that happen before the
+	// request is sent (e.g. DNS errors or refused connections) and may not
+	// happen again.
+	Transient = Class("transient")
+
+	// Unknown errors are transport failures after the request may have
+	// been sent (e.g. timeouts or reset connections): whether the machine
+	// is being rebooted is unknown.
+	Unknown = Class("unknown")
+
+	// ServerError is returned when the Reboot API fails with a 5xx status.
+	ServerError = Class("server")
+
+	// AuthError is returned when the Reboot API rejects the credentials.
+	AuthError = Class("auth")
+
+	// Permanent errors are specific to the host being rebooted (e.g. "host
+	// not found") and would happen again on retry.
+	Permanent = Class("permanent")
+
+	// CircuitOpen is returned without sending the request when the circuit
+	// breaker around the Reboot API is open.
+	CircuitOpen = Class("circuit-open")
+)
+
+// Error is a failed reboot request. Status and Code are the HTTP status
+// and status code of the response, if any.
+type Error struct {
+	Class  Class
+	Status string
+	Code   int
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Status != "" {
+		return fmt.Sprintf("%s error (%s): %v", e.Class, e.Status, e.Err)
+	}
+	return fmt.Sprintf("%s error: %v", e.Class, e.Err)
+}
+
+// ClassOf returns the class of err. Errors not returned by a Rebooter are
+// Permanent.
+func ClassOf(err error) Class {
+	if e, ok := err.(*Error); ok {
+		return e.Class
+	}
+	return Permanent
+}
+
+// Retryable returns true if the request failing with err can be retried,
+// i.e. if it provably did not reach the server: the failure was transient
+// or the server was unavailable (503). Reboots are not idempotent, so other
+// failures are not retried.
+func Retryable(err error) bool {
+	e, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+	return e.Class == Transient ||
+		(e.Class == ServerError && e.Code == http.StatusServiceUnavailable)
+}
+
+// transportClass returns the class of an error returned by http.Client.Do:
+// Transient if the connection could not be established, Unknown otherwise.
+func transportClass(err error) Class {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	switch e := err.(type) {
+	case *net.DNSError:
+		return Transient
+	case *net.OpError:
+		if e.Op == "dial" {
+			return Transient
+		}
+	}
+	return Unknown
+}
+
+// statusClass returns the class of the error corresponding to an HTTP
+// status code other than 200.
+func statusClass(code int) Class {
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return AuthError
+	case code >= 500:
+		return ServerError
+	default:
+		return Permanent
+	}
+}
@@ -1,9 +1,13 @@
 package reboot
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/m-lab/rebot/node"
 	"github.com/prometheus/client_golang/prometheus"
@@ -37,6 +41,59 @@ var (
 	}
 )
 
+// Result is the outcome of a Many call. Rebooted contains the nodes for which
+// the reboot request succeeded, and Failed maps the name of the nodes for
+// which the request failed to the corresponding error.
+type Result struct {
+	Rebooted []node.Node
+	Failed   map[string]error
+}
+
+// newResult returns an empty Result.
+func newResult() Result {
+	return Result{
+		Rebooted: []node.Node{},
+		Failed:   map[string]error{},
+	}
+}
+
+// Config configures how a HTTPRebooter sends requests.
+//
+// Each request is cancelled after Timeout. If zero, requests only end with
+// the client's timeout or the caller's context. At most Concurrency
+// requests are in flight at once, and at most one per site.
+//
+// Requests failing with a Retryable error are retried up to Retries times,
+// waiting Backoff before the first retry and twice as long before each of
+// the following ones.
+//
+// After BreakerThreshold consecutive API-level failures, no request is sent
+// for BreakerCooldown (see Breaker). A zero BreakerThreshold disables the
+// circuit breaker.
+type Config struct {
+	Timeout     time.Duration
+	Concurrency int
+	Retries     int
+	Backoff     time.Duration
+
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// DefaultConfig returns a Config sending 5 requests at once, retrying
+// twice after 10 and 20 seconds, and pausing for 10 minutes after 5
+// consecutive API-level failures.
+func DefaultConfig() Config {
+	return Config{
+		Timeout:          90 * time.Second,
+		Concurrency:      5,
+		Retries:          2,
+		Backoff:          10 * time.Second,
+		BreakerThreshold: 5,
+		BreakerCooldown:  10 * time.Minute,
+	}
+}
+
 // HTTPRebooter reboots one of more nodes calling the Reboot API via the
 // provided http.Client.
 type HTTPRebooter struct {
@@ -44,29 +101,86 @@ type HTTPRebooter struct {
 	baseURL  string
 	username string
 	password string
+	config   Config
+	breaker  *Breaker
 }
 
-// NewHTTPRebooter returns a HTTPRebooter with the provided fields.
-func NewHTTPRebooter(c *http.Client, baseURL, username, password string) *HTTPRebooter {
+// NewHTTPRebooter returns a HTTPRebooter with the provided fields. If
+// config.Concurrency is less than 1, requests are sent one at a time.
+func NewHTTPRebooter(c *http.Client, baseURL, username, password string,
+	config Config) *HTTPRebooter {
 	return &HTTPRebooter{
 		client:   c,
 		baseURL:  baseURL + rebootEndpoint,
 		username: username,
 		password: password,
+		config:   config,
+		breaker:  NewBreaker(config.BreakerThreshold, config.BreakerCooldown),
+	}
+}
+
+// retry reboots a single machine via one, retrying the requests failing
+// with a Retryable error with exponential backoff. It returns the last
+// error.
+func retry(ctx context.Context, config Config, toReboot node.Node,
+	one func(context.Context, node.Node) error) error {
+	backoff := config.Backoff
+	for retry := 0; ; retry++ {
+		err := one(ctx, toReboot)
+		if err == nil || !Retryable(err) || retry >= config.Retries {
+			return err
+		}
+
+		log.WithError(err).WithFields(log.Fields{"node": toReboot.Name,
+			"backoff": backoff}).Warn("Reboot request failed, retrying.")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// one reboots a single machine through the circuit breaker, with retries.
+// The breaker records the outcome of the reboot rather than of each
+// request, and failures caused by ctx being done are not recorded as such.
+func (r *HTTPRebooter) one(ctx context.Context, toReboot node.Node) error {
+	err := r.breaker.Allow()
+	if err != nil {
+		log.WithError(err).WithField("node", toReboot.Name).Warn("Not sending reboot request.")
+		metricRebootRequests.WithLabelValues(toReboot.Name, toReboot.Site, "reboot",
+			string(CircuitOpen)).Add(1)
+		return err
 	}
+
+	err = retry(ctx, r.config, toReboot, r.send)
+	if err != nil && ctx.Err() != nil {
+		r.breaker.Record(ctx.Err())
+	} else {
+		r.breaker.Record(err)
+	}
+	return err
 }
 
-// one reboots a single machine by send an HTTP request to the Reboot API
-// and returns an error if the response code is not 200 or there is a timeout.
-func (r *HTTPRebooter) one(toReboot node.Node) error {
+// send reboots a single machine by send an HTTP request to the Reboot API
+// and returns an *Error if the response code is not 200 or there is a
+// timeout.
+func (r *HTTPRebooter) send(ctx context.Context, toReboot node.Node) error {
 	rebootURL := r.baseURL + "?host=" + toReboot.Name
 
 	// Create the HTTP request
 	request, err := newHTTPRequest(http.MethodPost, rebootURL, nil)
 	if err != nil {
 		log.WithError(err).Error("Cannot create HTTP request.")
-		return err
+		return fail(toReboot, "reboot", &Error{Class: Permanent, Err: err})
 	}
+	if r.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.config.Timeout)
+		defer cancel()
+	}
+	request = request.WithContext(ctx)
 
 	// Add HTTP authentication if needed.
 	if r.username != "" && r.password != "" {
@@ -77,22 +191,25 @@ func (r *HTTPRebooter) one(toReboot node.Node) error {
 	response, err := clientDo(r, request)
 	if err != nil {
 		log.WithError(err).Error("Cannot send reboot request.")
-		metricRebootRequests.WithLabelValues(toReboot.Name, toReboot.Site, "reboot", "failure-request").Add(1)
-		return err
+		return fail(toReboot, "reboot", &Error{Class: transportClass(err), Err: err})
 	}
 	defer response.Body.Close()
 
 	body, err := readAll(response.Body)
 	if err != nil {
 		log.WithError(err).Error(err)
-		metricRebootRequests.WithLabelValues(toReboot.Name, toReboot.Site, "reboot", "failure-read").Add(1)
-		return err
+		return fail(toReboot, "reboot", &Error{Class: Unknown, Status: response.Status,
+			Code: response.StatusCode, Err: err})
 	}
 
 	if response.StatusCode != http.StatusOK {
 		log.Error(string(body))
-		metricRebootRequests.WithLabelValues(toReboot.Name, toReboot.Site, "reboot", "failure-status").Add(1)
-		return errors.New(string(body))
+		return fail(toReboot, "reboot", &Error{
+			Class:  statusClass(response.StatusCode),
+			Status: response.Status,
+			Code:   response.StatusCode,
+			Err:    errors.New(strings.TrimSpace(string(body))),
+		})
 	}
 
 	metricRebootRequests.WithLabelValues(toReboot.Name, toReboot.Site, "reboot", "success").Add(1)
@@ -101,32 +218,91 @@ func (r *HTTPRebooter) one(toReboot node.Node) error {
 	return nil
 }
 
-// Many reboots an array of machines and returns a map of
-// machineName -> error for each element for which the rebootMany failed.
-func (r *HTTPRebooter) Many(toReboot []node.Node) map[string]error {
-	errors := make(map[string]error)
+// fail counts the failed request of the given type with its class as the
+// status and returns the error.
+func fail(toReboot node.Node, rebootType string, err *Error) error {
+	metricRebootRequests.WithLabelValues(toReboot.Name, toReboot.Site, rebootType,
+		string(err.Class)).Add(1)
+	return err
+}
+
+// Many reboots an array of machines and returns a Result listing which of
+// them were rebooted and which failed, in the order they were provided.
+// Limiting how many machines are rebooted is up to the caller. Once ctx is
+// done, the pending requests fail.
+//
+// Sites are handled by a pool of Config.Concurrency workers, each rebooting
+// the nodes of a site one at a time.
+func (r *HTTPRebooter) Many(ctx context.Context, toReboot []node.Node) Result {
+	return dispatch(ctx, r.config, toReboot, r.one)
+}
+
+// dispatch reboots the machines via one, through a pool of
+// config.Concurrency workers each rebooting the nodes of a site one at a
+// time. It returns the Result in the order the machines were provided.
+func dispatch(ctx context.Context, config Config, toReboot []node.Node,
+	one func(context.Context, node.Node) error) Result {
+	result := newResult()
 
 	if len(toReboot) == 0 {
 		log.Info("There are no nodes to reboot.")
-		return errors
+		return result
 	}
 
-	// If there are more than 5 nodes to be rebooted, do nothing.
-	// TODO(roberto) find a better way to report this case to the caller.
-	if len(toReboot) > 5 {
-		log.WithFields(log.Fields{"nodes": toReboot}).Error("There are more than 5 nodes offline, skipping.")
-		return errors
+	log.WithFields(log.Fields{"nodes": toReboot}).Info("These nodes are going to be rebooted.")
+
+	// Group the nodes by site, preserving the order.
+	sites := [][]node.Node{}
+	index := map[string]int{}
+	for _, n := range toReboot {
+		i, ok := index[n.Site]
+		if !ok {
+			i = len(sites)
+			index[n.Site] = i
+			sites = append(sites, nil)
+		}
+		sites[i] = append(sites[i], n)
 	}
 
-	log.WithFields(log.Fields{"nodes": toReboot}).Info("These nodes are going to be rebooted.")
+	errs := make(map[string]error, len(toReboot))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan []node.Node)
+	workers := config.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(sites) {
+		workers = len(sites)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for site := range jobs {
+				for _, n := range site {
+					log.WithFields(log.Fields{"node": n}).Info("Rebooting node...")
+					err := one(ctx, n)
+					mu.Lock()
+					errs[n.Name] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, site := range sites {
+		jobs <- site
+	}
+	close(jobs)
+	wg.Wait()
 
-	for _, c := range toReboot {
-		log.WithFields(log.Fields{"node": c}).Info("Rebooting node...")
-		err := r.one(c)
-		if err != nil {
-			errors[c.Name] = err
+	for _, n := range toReboot {
+		if err := errs[n.Name]; err != nil {
+			result.Failed[n.Name] = err
+			continue
 		}
+		result.Rebooted = append(result.Rebooted, n)
 	}
 
-	return errors
+	return result
 }
@@ -2,17 +2,24 @@ package reboot
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/m-lab/go/prometheusx/promtest"
 	"github.com/m-lab/rebot/node"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type RoundTripFunc func(req *http.Request) *http.Response
@@ -80,7 +87,8 @@ func Test_rebootMany(t *testing.T) {
 		}
 	})
 
-	rebooter := NewHTTPRebooter(client, "/v1/reboot", "user", "pass")
+	rebooter := NewHTTPRebooter(client, "/v1/reboot", "user", "pass",
+		Config{Timeout: time.Minute, Concurrency: 2})
 
 	// These must succeed.
 	toReboot := []node.Node{
@@ -93,10 +101,13 @@ func Test_rebootMany(t *testing.T) {
 			Site: "lga0t",
 		},
 	}
-	want := map[string]error{}
+	want := Result{
+		Rebooted: toReboot,
+		Failed:   map[string]error{},
+	}
 
 	t.Run("success-all-nodes-rebooted", func(t *testing.T) {
-		if got := rebooter.Many(toReboot); !reflect.DeepEqual(got, want) {
+		if got := rebooter.Many(context.Background(), toReboot); !reflect.DeepEqual(got, want) {
 			t.Errorf("rebootMany() = %v, want %v", got, want)
 		}
 	})
@@ -110,16 +121,19 @@ func Test_rebootMany(t *testing.T) {
 	}
 
 	t.Run("failure-exit-code-non-zero", func(t *testing.T) {
-		got := rebooter.Many(toReboot)
-		if err, ok := got["mlab4.lga0t.measurement-lab.org"]; !ok || err == nil {
+		got := rebooter.Many(context.Background(), toReboot)
+		if err, ok := got.Failed["mlab4.lga0t.measurement-lab.org"]; !ok || err == nil {
 			t.Errorf("rebootMany() = %v, key not in map or err == nil", got)
 		}
+		if len(got.Rebooted) != 0 {
+			t.Errorf("rebootMany() = %v, failed node reported as rebooted", got)
+		}
 	})
 
 	t.Run("success-empty-slice", func(t *testing.T) {
-		got := rebooter.Many([]node.Node{})
-		if got == nil || len(got) != 0 {
-			t.Errorf("rebootMany() = %v, error map not empty.", got)
+		got := rebooter.Many(context.Background(), []node.Node{})
+		if got.Failed == nil || len(got.Failed) != 0 || len(got.Rebooted) != 0 {
+			t.Errorf("rebootMany() = %v, result not empty.", got)
 		}
 	})
 
@@ -149,10 +163,10 @@ func Test_rebootMany(t *testing.T) {
 			Site: "lga1t",
 		},
 	}
-	t.Run("success-too-many-nodes", func(t *testing.T) {
-		got := rebooter.Many(toReboot)
-		if got == nil || len(got) != 0 {
-			t.Errorf("rebootMany() = %v, error map not empty.", got)
+	t.Run("success-many-nodes", func(t *testing.T) {
+		got := rebooter.Many(context.Background(), toReboot)
+		if len(got.Failed) != 0 || !reflect.DeepEqual(got.Rebooted, toReboot) {
+			t.Errorf("rebootMany() = %v, want all nodes rebooted", got)
 		}
 	})
 
@@ -170,10 +184,10 @@ func Test_rebootMany(t *testing.T) {
 			return nil, errors.New("Error while creating HTTP request")
 		}
 
-		got := rebooter.Many(toReboot)
+		got := rebooter.Many(context.Background(), toReboot)
 		newHTTPRequest = oldHTTPRequestFunc
 
-		if _, ok := got["mlab1.lga0t.measurement-lab.org"]; !ok {
+		if _, ok := got.Failed["mlab1.lga0t.measurement-lab.org"]; !ok {
 			t.Errorf("rebootMany() = %v, key not in map", got)
 		}
 	})
@@ -186,10 +200,10 @@ func Test_rebootMany(t *testing.T) {
 			return nil, errors.New("Cannot read")
 		}
 
-		got := rebooter.Many(toReboot)
+		got := rebooter.Many(context.Background(), toReboot)
 		readAll = oldReadAllFunc
 
-		if _, ok := got["mlab1.lga0t.measurement-lab.org"]; !ok {
+		if _, ok := got.Failed["mlab1.lga0t.measurement-lab.org"]; !ok {
 			t.Errorf("rebootMany() = %v, key not in map", got)
 		}
 
@@ -203,10 +217,10 @@ func Test_rebootMany(t *testing.T) {
 			return nil, errors.New("Cannot send request")
 		}
 
-		got := rebooter.Many(toReboot)
+		got := rebooter.Many(context.Background(), toReboot)
 		clientDo = oldClientDo
 
-		if _, ok := got["mlab1.lga0t.measurement-lab.org"]; !ok {
+		if _, ok := got.Failed["mlab1.lga0t.measurement-lab.org"]; !ok {
 			t.Errorf("rebootMany() = %v, key not in map", got)
 		}
 
@@ -214,6 +228,274 @@ func Test_rebootMany(t *testing.T) {
 
 }
 
+func Test_rebootManyTimeout(t *testing.T) {
+	// The fake Reboot API never answers before the request is cancelled.
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer srv.Close()
+
+	toReboot := []node.Node{node.New("mlab1.lga0t.measurement-lab.org", "lga0t")}
+
+	rebooter := NewHTTPRebooter(http.DefaultClient, srv.URL, "", "",
+		Config{Timeout: 10 * time.Millisecond})
+	got := rebooter.Many(context.Background(), toReboot)
+	if err, ok := got.Failed[toReboot[0].Name]; !ok ||
+		!strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("Many() = %v, want the request to time out", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rebooter = NewHTTPRebooter(http.DefaultClient, srv.URL, "", "", Config{})
+	got = rebooter.Many(ctx, toReboot)
+	if err, ok := got.Failed[toReboot[0].Name]; !ok ||
+		!strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("Many() = %v, want the request to be cancelled", got)
+	}
+}
+
+func Test_rebootManyConcurrency(t *testing.T) {
+	// The fake Reboot API records how many requests are in flight, in
+	// total and per site.
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	sites := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		n, err := node.Parse(req.URL.Query().Get("host"))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		inFlight++
+		sites[n.Site]++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		if sites[n.Site] > 1 {
+			t.Errorf("Many() rebooted two nodes of %s at once", n.Site)
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		sites[n.Site]--
+		mu.Unlock()
+		if strings.HasPrefix(n.Name, "mlab4") {
+			http.Error(rw, "i/o error", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	toReboot := []node.Node{}
+	for _, site := range []string{"lga0t", "lga1t", "iad0t", "iad1t"} {
+		for _, m := range []string{"mlab1", "mlab2", "mlab4"} {
+			toReboot = append(toReboot, node.New(m+"."+site+".measurement-lab.org", site))
+		}
+	}
+
+	rebooter := NewHTTPRebooter(http.DefaultClient, srv.URL, "", "",
+		Config{Timeout: time.Minute, Concurrency: 3})
+	got := rebooter.Many(context.Background(), toReboot)
+
+	if maxInFlight < 2 || maxInFlight > 3 {
+		t.Errorf("Many() sent up to %d requests at once, want 2 or 3", maxInFlight)
+	}
+	if len(got.Rebooted) != 8 || len(got.Failed) != 4 {
+		t.Fatalf("Many() = %v, want 8 nodes rebooted and 4 failed", got)
+	}
+	for i, n := range got.Rebooted {
+		if n != toReboot[i+i/2] {
+			t.Errorf("Many() rebooted %v at position %d, want the input order", n, i)
+		}
+	}
+	for name := range got.Failed {
+		if !strings.HasPrefix(name, "mlab4") {
+			t.Errorf("Many() failed to reboot %s", name)
+		}
+	}
+}
+
+func Test_rebootRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []int
+		wantCalls int
+		wantClass Class
+		// Number of requests counted with the server error status.
+		wantServerErrors int
+	}{
+		{
+			name: "success-after-unavailable",
+			responses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable,
+				http.StatusOK},
+			wantCalls: 3,
+
+			wantServerErrors: 2,
+		},
+		{
+			name:      "failure-server-error-not-retried",
+			responses: []int{http.StatusBadGateway, http.StatusOK},
+			wantCalls: 1,
+			wantClass: ServerError,
+
+			wantServerErrors: 1,
+		},
+		{
+			name:      "failure-retries-exhausted",
+			responses: []int{http.StatusServiceUnavailable},
+			wantCalls: 3,
+			wantClass: ServerError,
+
+			wantServerErrors: 3,
+		},
+		{
+			name:      "failure-auth-not-retried",
+			responses: []int{http.StatusUnauthorized},
+			wantCalls: 1,
+			wantClass: AuthError,
+		},
+		{
+			name:      "failure-permanent-not-retried",
+			responses: []int{http.StatusNotFound},
+			wantCalls: 1,
+			wantClass: Permanent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				code := tt.responses[len(tt.responses)-1]
+				if calls < len(tt.responses) {
+					code = tt.responses[calls]
+				}
+				calls++
+				rw.WriteHeader(code)
+				fmt.Fprintln(rw, http.StatusText(code))
+			}))
+			defer srv.Close()
+
+			n := node.New("mlab1.lga0t.measurement-lab.org", "lga0t")
+			before := testutil.ToFloat64(metricRebootRequests.WithLabelValues(
+				n.Name, n.Site, "reboot", string(ServerError)))
+			rebooter := NewHTTPRebooter(http.DefaultClient, srv.URL, "", "", Config{
+				Retries: 2,
+				Backoff: time.Millisecond,
+			})
+			got := rebooter.Many(context.Background(), []node.Node{n})
+
+			if calls != tt.wantCalls {
+				t.Errorf("Many() sent %d requests, want %d", calls, tt.wantCalls)
+			}
+			err, failed := got.Failed[n.Name]
+			if failed != (tt.wantClass != "") || (failed && ClassOf(err) != tt.wantClass) {
+				t.Errorf("Many() = %v, want class %q", got, tt.wantClass)
+			}
+			after := testutil.ToFloat64(metricRebootRequests.WithLabelValues(
+				n.Name, n.Site, "reboot", string(ServerError)))
+			if int(after-before) != tt.wantServerErrors {
+				t.Errorf("Many() counted %v server errors, want %d", after-before,
+					tt.wantServerErrors)
+			}
+		})
+	}
+
+	t.Run("failure-transient-cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		oldClientDo := clientDo
+		clientDo = func(r *HTTPRebooter, req *http.Request) (*http.Response, error) {
+			cancel()
+			return nil, &url.Error{Op: "Post", URL: req.URL.String(),
+				Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+		}
+		defer func() { clientDo = oldClientDo }()
+
+		n := node.New("mlab1.lga0t.measurement-lab.org", "lga0t")
+		rebooter := NewHTTPRebooter(http.DefaultClient, "", "", "", Config{
+			Retries: 2,
+			Backoff: time.Hour,
+		})
+		got := rebooter.Many(ctx, []node.Node{n})
+		if err := got.Failed[n.Name]; ClassOf(err) != Transient {
+			t.Errorf("Many() = %v, want a transient error", got)
+		}
+	})
+}
+
+func Test_rebootTimeoutNotRetried(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-unblock
+	}))
+	defer srv.Close()
+
+	// The request reached the server: the machine may be rebooting.
+	n := node.New("mlab1.lga0t.measurement-lab.org", "lga0t")
+	rebooter := NewHTTPRebooter(http.DefaultClient, srv.URL, "", "", Config{
+		Timeout: 50 * time.Millisecond,
+		Retries: 2,
+		Backoff: time.Millisecond,
+	})
+	got := rebooter.Many(context.Background(), []node.Node{n})
+	if err := got.Failed[n.Name]; ClassOf(err) != Unknown || Retryable(err) {
+		t.Errorf("Many() = %v, want an unknown error", got)
+	}
+	mu.Lock()
+	if calls != 1 {
+		t.Errorf("Many() sent %d requests, want 1", calls)
+	}
+	mu.Unlock()
+
+	// Connections refused are retried.
+	close(unblock)
+	srv.Close()
+	got = rebooter.Many(context.Background(), []node.Node{n})
+	if err := got.Failed[n.Name]; ClassOf(err) != Transient {
+		t.Errorf("Many() = %v, want a transient error", got)
+	}
+}
+
+func TestClassOf(t *testing.T) {
+	tests := []struct {
+		err       error
+		want      Class
+		retryable bool
+	}{
+		{err: &Error{Class: Transient, Err: errors.New("timeout")}, want: Transient, retryable: true},
+		{err: &Error{Class: Unknown, Err: errors.New("timeout")}, want: Unknown},
+		{err: &Error{Class: ServerError, Status: "500", Code: 500}, want: ServerError},
+		{err: &Error{Class: ServerError, Status: "503", Code: 503}, want: ServerError, retryable: true},
+		{err: &Error{Class: AuthError, Status: "401"}, want: AuthError},
+		{err: &Error{Class: Permanent, Status: "404"}, want: Permanent},
+		{err: errors.New("unknown"), want: Permanent},
+	}
+	for _, tt := range tests {
+		if got := ClassOf(tt.err); got != tt.want {
+			t.Errorf("ClassOf(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+		if got := Retryable(tt.err); got != tt.retryable {
+			t.Errorf("Retryable(%v) = %v, want %v", tt.err, got, tt.retryable)
+		}
+	}
+
+	err := &Error{Class: ServerError, Status: "500 Internal Server Error",
+		Err: errors.New("i/o error")}
+	if err.Error() != "server error (500 Internal Server Error): i/o error" {
+		t.Errorf("Error() = %q", err.Error())
+	}
+}
+
 func TestMetrics(t *testing.T) {
 	metricRebootRequests.WithLabelValues("x", "x", "x", "x")
 	promtest.LintMetrics(t)
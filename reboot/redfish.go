@@ -0,0 +1,278 @@
+package reboot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/m-lab/rebot/node"
+	log "github.com/sirupsen/logrus"
+)
+
+// Reset types of Redfish's ComputerSystem.Reset action supported by
+// RedfishRebooter.
+const (
+	ForceRestart = "ForceRestart"
+	PowerCycle   = "PowerCycle"
+)
+
+// Path of the ComputerSystem collection, relative to the BMC's root.
+const systemsEndpoint = "/redfish/v1/Systems"
+
+// BMCCredentials are the credentials of a machine's BMC. Address is the
+// BMC's base URL (scheme://host[:port]). If empty, it's https:// followed by
+// the name returned by BMCName.
+type BMCCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Address  string `json:"address,omitempty"`
+}
+
+// Credentials holds the credentials of the BMCs. Default applies to every
+// machine, and the entries of Machines, by machine name, override its
+// non-empty fields.
+type Credentials struct {
+	Default  BMCCredentials            `json:"default"`
+	Machines map[string]BMCCredentials `json:"machines,omitempty"`
+}
+
+// LoadCredentials reads the credentials from a JSON file. Short machine
+// names (e.g. mlab1.lga0t) are expanded.
+func LoadCredentials(path string) (*Credentials, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := &Credentials{}
+	err = json.Unmarshal(content, creds)
+	if err != nil {
+		return nil, err
+	}
+	if creds.Default.Username == "" && len(creds.Machines) == 0 {
+		return nil, fmt.Errorf("%s: no credentials", path)
+	}
+
+	machines := make(map[string]BMCCredentials, len(creds.Machines))
+	for name, c := range creds.Machines {
+		n, err := node.Parse(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		machines[n.Name] = c
+	}
+	creds.Machines = machines
+	return creds, nil
+}
+
+// For returns the credentials of the machine's BMC.
+func (c *Credentials) For(n node.Node) BMCCredentials {
+	creds := c.Default
+	if m, ok := c.Machines[n.Name]; ok {
+		if m.Username != "" {
+			creds.Username = m.Username
+		}
+		if m.Password != "" {
+			creds.Password = m.Password
+		}
+		if m.Address != "" {
+			creds.Address = m.Address
+		}
+	}
+	if creds.Address == "" {
+		creds.Address = "https://" + BMCName(n)
+	}
+	creds.Address = strings.TrimSuffix(creds.Address, "/")
+	return creds
+}
+
+// BMCName returns the name of the machine's BMC, e.g.
+// mlab1d.lga0t.measurement-lab.org for mlab1.lga0t.measurement-lab.org.
+func BMCName(n node.Node) string {
+	i := strings.Index(n.Name, ".")
+	if i < 0 {
+		return n.Name + "d"
+	}
+	return n.Name[:i] + "d" + n.Name[i:]
+}
+
+// RedfishRebooter reboots nodes by sending a ComputerSystem.Reset action
+// to their BMC via the Redfish API, without going through the Reboot API.
+// The Config's circuit breaker settings are ignored, as every BMC is
+// independent.
+type RedfishRebooter struct {
+	client      *http.Client
+	credentials *Credentials
+	resetType   string
+	config      Config
+}
+
+// NewRedfishRebooter returns a RedfishRebooter using the given credentials.
+// resetType (ForceRestart or PowerCycle) is used if the BMC allows it,
+// otherwise the other one is.
+func NewRedfishRebooter(c *http.Client, credentials *Credentials, resetType string,
+	config Config) *RedfishRebooter {
+	return &RedfishRebooter{
+		client:      c,
+		credentials: credentials,
+		resetType:   resetType,
+		config:      config,
+	}
+}
+
+// Many reboots an array of machines and returns a Result listing which of
+// them were rebooted and which failed, in the order they were provided. It
+// sends requests like HTTPRebooter.Many.
+func (r *RedfishRebooter) Many(ctx context.Context, toReboot []node.Node) Result {
+	return dispatch(ctx, r.config, toReboot, func(ctx context.Context, n node.Node) error {
+		return retry(ctx, r.config, n, r.one)
+	})
+}
+
+// odataID is a reference to a Redfish resource.
+type odataID struct {
+	ID string `json:"@odata.id"`
+}
+
+// systemCollection is the subset of a ComputerSystemCollection rebot uses.
+type systemCollection struct {
+	Members []odataID `json:"Members"`
+}
+
+// computerSystem is the subset of a ComputerSystem rebot uses.
+type computerSystem struct {
+	PowerState string `json:"PowerState"`
+	Actions    struct {
+		Reset struct {
+			Target     string   `json:"target"`
+			ResetTypes []string `json:"ResetType@Redfish.AllowableValues"`
+		} `json:"#ComputerSystem.Reset"`
+	} `json:"Actions"`
+}
+
+// one resets the first computer system of the machine's BMC.
+func (r *RedfishRebooter) one(ctx context.Context, toReboot node.Node) error {
+	if r.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.config.Timeout)
+		defer cancel()
+	}
+	creds := r.credentials.For(toReboot)
+
+	var systems systemCollection
+	err := r.do(ctx, creds, http.MethodGet, systemsEndpoint, nil, &systems)
+	if err != nil {
+		return fail(toReboot, "redfish", err)
+	}
+	if len(systems.Members) == 0 {
+		return fail(toReboot, "redfish", &Error{Class: Permanent,
+			Err: errors.New("the BMC has no computer system")})
+	}
+
+	var system computerSystem
+	err = r.do(ctx, creds, http.MethodGet, systems.Members[0].ID, nil, &system)
+	if err != nil {
+		return fail(toReboot, "redfish", err)
+	}
+	reset := system.Actions.Reset
+	resetType := r.chooseResetType(reset.ResetTypes)
+	if reset.Target == "" || resetType == "" {
+		return fail(toReboot, "redfish", &Error{Class: Permanent,
+			Err: fmt.Errorf("the BMC does not support %s or %s", ForceRestart, PowerCycle)})
+	}
+
+	log.WithFields(log.Fields{"node": toReboot.Name, "system": systems.Members[0].ID,
+		"power": system.PowerState, "type": resetType}).Debug("Resetting computer system.")
+	err = r.do(ctx, creds, http.MethodPost, reset.Target,
+		map[string]string{"ResetType": resetType}, nil)
+	if err != nil {
+		return fail(toReboot, "redfish", err)
+	}
+
+	metricRebootRequests.WithLabelValues(toReboot.Name, toReboot.Site, "redfish", "success").Add(1)
+	return nil
+}
+
+// chooseResetType returns the configured reset type if allowed, otherwise
+// the other supported one if allowed, or an empty string. An empty list
+// allows any type.
+func (r *RedfishRebooter) chooseResetType(allowed []string) string {
+	if len(allowed) == 0 {
+		return r.resetType
+	}
+	for _, t := range []string{r.resetType, ForceRestart, PowerCycle} {
+		for _, a := range allowed {
+			if a == t {
+				return t
+			}
+		}
+	}
+	return ""
+}
+
+// do sends a request to the BMC for the given path, with body encoded as
+// JSON if not nil, and decodes the JSON response into v if not nil. It
+// returns an *Error.
+func (r *RedfishRebooter) do(ctx context.Context, creds BMCCredentials, method,
+	path string, body, v interface{}) *Error {
+	var content []byte
+	if body != nil {
+		var err error
+		content, err = json.Marshal(body)
+		if err != nil {
+			return &Error{Class: Permanent, Err: err}
+		}
+	}
+
+	req, err := newHTTPRequest(method, creds.Address+path, bytes.NewReader(content))
+	if err != nil {
+		return &Error{Class: Permanent, Err: err}
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(creds.Username, creds.Password)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("OData-Version", "4.0")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	// GET requests can be retried after any transport error, but a reset
+	// might have been received and must not be sent again.
+	failure := Transient
+	if method != http.MethodGet {
+		failure = Unknown
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return &Error{Class: failure, Err: err}
+	}
+	defer resp.Body.Close()
+
+	content, err = readAll(resp.Body)
+	if err != nil {
+		return &Error{Class: failure, Status: resp.Status, Code: resp.StatusCode, Err: err}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &Error{
+			Class:  statusClass(resp.StatusCode),
+			Status: resp.Status,
+			Code:   resp.StatusCode,
+			Err:    fmt.Errorf("%s %s: %s", method, path, strings.TrimSpace(string(content))),
+		}
+	}
+	if v == nil {
+		return nil
+	}
+	err = json.Unmarshal(content, v)
+	if err != nil {
+		return &Error{Class: ServerError, Status: resp.Status, Code: resp.StatusCode,
+			Err: fmt.Errorf("%s %s: %v", method, path, err)}
+	}
+	return nil
+}
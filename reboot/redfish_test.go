@@ -0,0 +1,226 @@
+package reboot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/rebot/node"
+)
+
+// fakeBMC is a minimal Redfish service with a single computer system.
+type fakeBMC struct {
+	username   string
+	password   string
+	resetTypes []string
+	// hang makes the BMC never respond to resets.
+	hang bool
+
+	mu     sync.Mutex
+	resets []string
+}
+
+func (b *fakeBMC) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	user, pass, ok := req.BasicAuth()
+	if !ok || user != b.username || pass != b.password {
+		http.Error(rw, `{"error": {"code": "Base.1.0.InsufficientPrivilege"}}`,
+			http.StatusUnauthorized)
+		return
+	}
+
+	const system = "/redfish/v1/Systems/System.Embedded.1"
+	switch {
+	case req.Method == http.MethodGet && req.URL.Path == "/redfish/v1/Systems":
+		fmt.Fprintf(rw, `{"Members": [{"@odata.id": %q}]}`, system)
+	case req.Method == http.MethodGet && req.URL.Path == system:
+		types, _ := json.Marshal(b.resetTypes)
+		fmt.Fprintf(rw, `{"PowerState": "On", "Actions": {"#ComputerSystem.Reset": {
+			"target": %q, "ResetType@Redfish.AllowableValues": %s}}}`,
+			system+"/Actions/ComputerSystem.Reset", types)
+	case req.Method == http.MethodPost && req.URL.Path == system+"/Actions/ComputerSystem.Reset":
+		var body struct{ ResetType string }
+		rtx.Must(json.NewDecoder(req.Body).Decode(&body), "Cannot decode reset")
+		b.mu.Lock()
+		b.resets = append(b.resets, body.ResetType)
+		b.mu.Unlock()
+		if b.hang {
+			<-req.Context().Done()
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func TestRedfishRebooter(t *testing.T) {
+	n := node.New("mlab1.lga0t.measurement-lab.org", "lga0t")
+	tests := []struct {
+		name       string
+		resetTypes []string
+		resetType  string
+		password   string
+		wantResets []string
+		wantClass  Class
+	}{
+		{
+			name:       "success-force-restart",
+			resetTypes: []string{"On", ForceRestart, PowerCycle},
+			resetType:  ForceRestart,
+			password:   "secret",
+			wantResets: []string{ForceRestart},
+		},
+		{
+			name:       "success-power-cycle",
+			resetTypes: []string{ForceRestart, PowerCycle},
+			resetType:  PowerCycle,
+			password:   "secret",
+			wantResets: []string{PowerCycle},
+		},
+		{
+			name:       "success-fallback",
+			resetTypes: []string{"On", PowerCycle},
+			resetType:  ForceRestart,
+			password:   "secret",
+			wantResets: []string{PowerCycle},
+		},
+		{
+			name:       "failure-unsupported",
+			resetTypes: []string{"On", "ForceOff"},
+			resetType:  ForceRestart,
+			password:   "secret",
+			wantClass:  Permanent,
+		},
+		{
+			name:       "failure-auth",
+			resetTypes: []string{ForceRestart},
+			resetType:  ForceRestart,
+			password:   "wrong",
+			wantClass:  AuthError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bmc := &fakeBMC{username: "root", password: "secret", resetTypes: tt.resetTypes}
+			srv := httptest.NewServer(bmc)
+			defer srv.Close()
+
+			creds := &Credentials{
+				Default: BMCCredentials{Username: "root", Password: "wrong"},
+				Machines: map[string]BMCCredentials{
+					n.Name: {Password: tt.password, Address: srv.URL + "/"},
+				},
+			}
+			r := NewRedfishRebooter(http.DefaultClient, creds, tt.resetType,
+				Config{Timeout: time.Minute, Retries: 2, Backoff: time.Millisecond})
+			got := r.Many(context.Background(), []node.Node{n})
+
+			if !reflect.DeepEqual(bmc.resets, tt.wantResets) {
+				t.Errorf("Many() sent resets %v, want %v", bmc.resets, tt.wantResets)
+			}
+			err, failed := got.Failed[n.Name]
+			if failed != (tt.wantClass != "") || (failed && ClassOf(err) != tt.wantClass) {
+				t.Errorf("Many() = %v, want class %q", got, tt.wantClass)
+			}
+		})
+	}
+
+	t.Run("failure-reset-timeout", func(t *testing.T) {
+		bmc := &fakeBMC{username: "root", password: "secret",
+			resetTypes: []string{ForceRestart}, hang: true}
+		srv := httptest.NewServer(bmc)
+		defer srv.Close()
+
+		creds := &Credentials{Default: BMCCredentials{Username: "root",
+			Password: "secret", Address: srv.URL}}
+		r := NewRedfishRebooter(http.DefaultClient, creds, ForceRestart,
+			Config{Timeout: 100 * time.Millisecond, Retries: 2, Backoff: time.Millisecond})
+		got := r.Many(context.Background(), []node.Node{n})
+
+		// The reset may have been received: it's not sent again.
+		if ClassOf(got.Failed[n.Name]) != Unknown {
+			t.Errorf("Many() = %v, want an unknown error", got)
+		}
+		bmc.mu.Lock()
+		defer bmc.mu.Unlock()
+		if len(bmc.resets) != 1 {
+			t.Errorf("Many() sent resets %v, want a single one", bmc.resets)
+		}
+	})
+
+	t.Run("failure-unreachable", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		srv.Close()
+		creds := &Credentials{Default: BMCCredentials{Address: srv.URL}}
+		r := NewRedfishRebooter(http.DefaultClient, creds, ForceRestart, Config{})
+		got := r.Many(context.Background(), []node.Node{n})
+		if ClassOf(got.Failed[n.Name]) != Transient {
+			t.Errorf("Many() = %v, want a transient error", got)
+		}
+	})
+}
+
+func TestLoadCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redfish")
+	rtx.Must(err, "Cannot create temporary directory")
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		rtx.Must(ioutil.WriteFile(path, []byte(content), 0600), "Cannot write %s", name)
+		return path
+	}
+
+	creds, err := LoadCredentials(write("valid.json", `{
+		"default": {"username": "root", "password": "calvin"},
+		"machines": {"mlab2.lga0t": {"password": "other", "address": "https://10.0.0.2"}}
+	}`))
+	if err != nil {
+		t.Fatalf("LoadCredentials() error = %v", err)
+	}
+	got := creds.For(node.New("mlab1.lga0t.measurement-lab.org", "lga0t"))
+	want := BMCCredentials{Username: "root", Password: "calvin",
+		Address: "https://mlab1d.lga0t.measurement-lab.org"}
+	if got != want {
+		t.Errorf("For() = %+v, want %+v", got, want)
+	}
+	got = creds.For(node.New("mlab2.lga0t.measurement-lab.org", "lga0t"))
+	want = BMCCredentials{Username: "root", Password: "other", Address: "https://10.0.0.2"}
+	if got != want {
+		t.Errorf("For() = %+v, want %+v", got, want)
+	}
+
+	for name, content := range map[string]string{
+		"invalid.json":    `{"default": `,
+		"empty.json":      `{}`,
+		"badmachine.json": `{"machines": {"notamachine": {"username": "root"}}}`,
+	} {
+		if _, err := LoadCredentials(write(name, content)); err == nil {
+			t.Errorf("LoadCredentials(%s) did not return an error", name)
+		}
+	}
+	if _, err := LoadCredentials(filepath.Join(dir, "notfound.json")); err == nil {
+		t.Errorf("LoadCredentials() of a missing file did not return an error")
+	}
+}
+
+func TestBMCName(t *testing.T) {
+	for name, want := range map[string]string{
+		"mlab1.lga0t.measurement-lab.org": "mlab1d.lga0t.measurement-lab.org",
+		"mlab4":                           "mlab4d",
+	} {
+		if got := BMCName(node.Node{Name: name}); got != want {
+			t.Errorf("BMCName(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+// Package schedule implements the maintenance windows and blackout periods
+// restricting when nodes can be rebooted.
+package schedule
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/rebot/node"
+)
+
+// Config is a set of maintenance windows and blackout periods.
+//
+// A node can only be rebooted inside one of the windows that apply to it,
+// if any, and never during a blackout period that applies to it. Nodes to
+// which no window applies can be rebooted at any time outside of blackouts.
+type Config struct {
+	Windows   []Window   `json:"windows"`
+	Blackouts []Blackout `json:"blackouts"`
+}
+
+// Scope selects the nodes a Window or a Blackout applies to. Project is
+// the name of the project rebot is running in and Site a regular
+// expression matching the whole site name. Empty fields match any node.
+type Scope struct {
+	Project string `json:"project"`
+	Site    string `json:"site"`
+
+	site *regexp.Regexp
+}
+
+// Window is a recurring daily time window, from Start to End ("15:04"
+// format) in Timezone, on the given Days ("Mon", "Tue", ...). If End is
+// before Start, the window ends on the next day. If Days is empty, the
+// window opens every day. Timezone defaults to UTC.
+type Window struct {
+	Scope
+	Timezone string   `json:"timezone"`
+	Days     []string `json:"days"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+
+	loc    *time.Location
+	days   map[time.Weekday]bool
+	start  time.Duration
+	length time.Duration
+}
+
+// Blackout is a period during which no node can be rebooted, such as a
+// platform-wide upgrade.
+type Blackout struct {
+	Scope
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Comment string    `json:"comment"`
+}
+
+// weekdays maps day names to time.Weekday.
+var weekdays = map[string]time.Weekday{}
+
+func init() {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		weekdays[strings.ToLower(d.String())] = d
+		weekdays[strings.ToLower(d.String()[:3])] = d
+	}
+}
+
+// LoadConfig reads a JSON schedule file.
+func LoadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	err = json.Unmarshal(content, config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks that every window and blackout is valid. It must be
+// called before using a Config that was not returned by LoadConfig.
+func (cfg *Config) Validate() error {
+	for i := range cfg.Windows {
+		err := cfg.Windows[i].compile()
+		if err != nil {
+			return fmt.Errorf("window %d: %v", i, err)
+		}
+	}
+	for i := range cfg.Blackouts {
+		err := cfg.Blackouts[i].compile()
+		if err != nil {
+			return fmt.Errorf("blackout %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// HoldReason returns why the node cannot be rebooted at time t when running
+// in project, or an empty string if it can. A nil Config never holds a
+// reboot.
+func (cfg *Config) HoldReason(n node.Node, project string, t time.Time) string {
+	if cfg == nil {
+		return ""
+	}
+
+	for _, b := range cfg.Blackouts {
+		if b.Match(n, project) && b.Contains(t) {
+			return fmt.Sprintf("blackout until %s: %s",
+				b.End.Format(time.RFC3339), b.Comment)
+		}
+	}
+
+	found := false
+	for _, w := range cfg.Windows {
+		if !w.Match(n, project) {
+			continue
+		}
+		if w.Contains(t) {
+			return ""
+		}
+		found = true
+	}
+	if found {
+		return "outside of the maintenance windows"
+	}
+	return ""
+}
+
+// NextOpen returns the first time, starting from t, at which the node can
+// be rebooted, looking up to a week ahead. It returns the zero time if
+// there is no such time.
+func (cfg *Config) NextOpen(n node.Node, project string, t time.Time) time.Time {
+	if cfg.HoldReason(n, project, t) == "" {
+		return t
+	}
+
+	// The schedule can only change when a blackout ends or a window opens.
+	changes := make([]time.Time, 0)
+	for _, b := range cfg.Blackouts {
+		if b.Match(n, project) && b.End.After(t) {
+			changes = append(changes, b.End)
+		}
+	}
+	for _, w := range cfg.Windows {
+		if w.Match(n, project) {
+			changes = append(changes, w.starts(t, t.Add(8*24*time.Hour))...)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Before(changes[j])
+	})
+
+	for _, c := range changes {
+		if cfg.HoldReason(n, project, c) == "" {
+			return c
+		}
+	}
+	return time.Time{}
+}
+
+// Match returns true if the scope includes the node when running in
+// project.
+func (s Scope) Match(n node.Node, project string) bool {
+	if s.Project != "" && s.Project != project {
+		return false
+	}
+	if s.site != nil && !s.site.MatchString(n.Site) {
+		return false
+	}
+	return true
+}
+
+func (s *Scope) compile() error {
+	if s.Site == "" {
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + s.Site + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid site regexp: %v", err)
+	}
+	s.site = re
+	return nil
+}
+
+// Contains returns true if the window is open at time t.
+func (w Window) Contains(t time.Time) bool {
+	// A window starting on the previous day may still be open.
+	local := t.In(w.loc)
+	for _, day := range []int{0, -1} {
+		start := w.startOn(local.AddDate(0, 0, day))
+		if w.days[start.Weekday()] && !t.Before(start) &&
+			t.Before(start.Add(w.length)) {
+			return true
+		}
+	}
+	return false
+}
+
+// startOn returns the time the window opens on the day of t, in the
+// window's timezone.
+func (w Window) startOn(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, int(w.start/time.Hour),
+		int(w.start%time.Hour/time.Minute), 0, 0, w.loc)
+}
+
+// starts returns the times the window opens between from and to.
+func (w Window) starts(from, to time.Time) []time.Time {
+	starts := make([]time.Time, 0)
+	for day := from.In(w.loc); !day.After(to); day = day.AddDate(0, 0, 1) {
+		start := w.startOn(day)
+		if w.days[start.Weekday()] && start.After(from) && !start.After(to) {
+			starts = append(starts, start)
+		}
+	}
+	return starts
+}
+
+func (w *Window) compile() error {
+	err := w.Scope.compile()
+	if err != nil {
+		return err
+	}
+
+	w.loc, err = time.LoadLocation(w.Timezone)
+	if err != nil {
+		return err
+	}
+
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return fmt.Errorf("invalid start: %v", err)
+	}
+	end, err := time.Parse("15:04", w.End)
+	if err != nil {
+		return fmt.Errorf("invalid end: %v", err)
+	}
+	w.start = time.Duration(start.Hour())*time.Hour +
+		time.Duration(start.Minute())*time.Minute
+	w.length = end.Sub(start)
+	if w.length <= 0 {
+		w.length += 24 * time.Hour
+	}
+
+	w.days = map[time.Weekday]bool{}
+	for _, name := range w.Days {
+		d, ok := weekdays[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("invalid day: %q", name)
+		}
+		w.days[d] = true
+	}
+	if len(w.Days) == 0 {
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			w.days[d] = true
+		}
+	}
+	return nil
+}
+
+// Contains returns true if the blackout is in effect at time t.
+func (b Blackout) Contains(t time.Time) bool {
+	return !t.Before(b.Start) && t.Before(b.End)
+}
+
+func (b *Blackout) compile() error {
+	err := b.Scope.compile()
+	if err != nil {
+		return err
+	}
+	if b.Start.IsZero() || b.End.IsZero() {
+		return errors.New("start and end are required")
+	}
+	if !b.End.After(b.Start) {
+		return errors.New("end must be after start")
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package schedule
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/rebot/node"
+)
+
+var (
+	lga = node.New("mlab1.lga0t.measurement-lab.org", "lga0t")
+	syd = node.New("mlab1.syd01.measurement-lab.org", "syd01")
+)
+
+// testConfig returns a Config with a weekday window for lga* sites in New
+// York, an overnight window for syd* sites in Sydney and a blackout for
+// every site on the 2019-01-09.
+func testConfig() *Config {
+	cfg := &Config{
+		Windows: []Window{
+			{
+				Scope:    Scope{Site: "lga.*"},
+				Timezone: "America/New_York",
+				Days:     []string{"Mon", "Tuesday", "wed", "Thu", "Fri"},
+				Start:    "09:00",
+				End:      "17:00",
+			},
+			{
+				Scope:    Scope{Site: "syd.*", Project: "mlab-oti"},
+				Timezone: "Australia/Sydney",
+				Start:    "22:00",
+				End:      "02:00",
+			},
+		},
+		Blackouts: []Blackout{
+			{
+				Start:   time.Date(2019, 1, 9, 0, 0, 0, 0, time.UTC),
+				End:     time.Date(2019, 1, 10, 0, 0, 0, 0, time.UTC),
+				Comment: "upgrade",
+			},
+		},
+	}
+	rtx.Must(cfg.Validate(), "Invalid test config")
+	return cfg
+}
+
+func TestConfig_HoldReason(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	rtx.Must(err, "Cannot load timezone")
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	rtx.Must(err, "Cannot load timezone")
+
+	tests := []struct {
+		name    string
+		n       node.Node
+		project string
+		t       time.Time
+		want    string
+	}{
+		{
+			name: "inside-window",
+			n:    lga,
+			// Monday.
+			t: time.Date(2019, 1, 7, 10, 0, 0, 0, ny),
+		},
+		{
+			name: "before-window",
+			n:    lga,
+			t:    time.Date(2019, 1, 7, 8, 59, 0, 0, ny),
+			want: "outside of the maintenance windows",
+		},
+		{
+			name: "window-end",
+			n:    lga,
+			t:    time.Date(2019, 1, 7, 17, 0, 0, 0, ny),
+			want: "outside of the maintenance windows",
+		},
+		{
+			name: "wrong-day",
+			n:    lga,
+			// Saturday.
+			t:    time.Date(2019, 1, 12, 10, 0, 0, 0, ny),
+			want: "outside of the maintenance windows",
+		},
+		{
+			name: "timezone",
+			n:    lga,
+			// 10:00 UTC is 05:00 in New York.
+			t:    time.Date(2019, 1, 7, 10, 0, 0, 0, time.UTC),
+			want: "outside of the maintenance windows",
+		},
+		{
+			name:    "overnight-window-after-midnight",
+			n:       syd,
+			project: "mlab-oti",
+			t:       time.Date(2019, 1, 8, 1, 0, 0, 0, sydney),
+		},
+		{
+			name:    "overnight-window-closed",
+			n:       syd,
+			project: "mlab-oti",
+			t:       time.Date(2019, 1, 8, 3, 0, 0, 0, sydney),
+			want:    "outside of the maintenance windows",
+		},
+		{
+			name:    "other-project-no-window",
+			n:       syd,
+			project: "mlab-sandbox",
+			t:       time.Date(2019, 1, 8, 3, 0, 0, 0, sydney),
+		},
+		{
+			name: "blackout",
+			n:    lga,
+			t:    time.Date(2019, 1, 9, 15, 0, 0, 0, time.UTC),
+			want: "blackout until 2019-01-10T00:00:00Z: upgrade",
+		},
+	}
+	cfg := testConfig()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cfg.HoldReason(tt.n, tt.project, tt.t); got != tt.want {
+				t.Errorf("Config.HoldReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	var nilConfig *Config
+	if got := nilConfig.HoldReason(lga, "", time.Now()); got != "" {
+		t.Errorf("Config.HoldReason() of a nil Config = %q, want \"\"", got)
+	}
+}
+
+func TestConfig_NextOpen(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	rtx.Must(err, "Cannot load timezone")
+
+	tests := []struct {
+		name string
+		n    node.Node
+		t    time.Time
+		want time.Time
+	}{
+		{
+			name: "open",
+			n:    lga,
+			t:    time.Date(2019, 1, 7, 10, 0, 0, 0, ny),
+			want: time.Date(2019, 1, 7, 10, 0, 0, 0, ny),
+		},
+		{
+			name: "same-day",
+			n:    lga,
+			t:    time.Date(2019, 1, 7, 6, 0, 0, 0, ny),
+			want: time.Date(2019, 1, 7, 9, 0, 0, 0, ny),
+		},
+		{
+			name: "after-weekend",
+			n:    lga,
+			t:    time.Date(2019, 1, 4, 18, 0, 0, 0, ny),
+			want: time.Date(2019, 1, 7, 9, 0, 0, 0, ny),
+		},
+		{
+			name: "after-blackout",
+			n:    syd,
+			t:    time.Date(2019, 1, 9, 12, 0, 0, 0, time.UTC),
+			want: time.Date(2019, 1, 10, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// The window on the day of the blackout is skipped.
+			name: "window-after-blackout",
+			n:    lga,
+			t:    time.Date(2019, 1, 8, 18, 0, 0, 0, ny),
+			want: time.Date(2019, 1, 10, 9, 0, 0, 0, ny),
+		},
+	}
+	cfg := testConfig()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cfg.NextOpen(tt.n, "", tt.t); !got.Equal(tt.want) {
+				t.Errorf("Config.NextOpen() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A blackout longer than a week.
+	cfg = &Config{Blackouts: []Blackout{{
+		Start: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC),
+	}}, Windows: []Window{{Start: "09:00", End: "10:00"}}}
+	rtx.Must(cfg.Validate(), "Invalid config")
+	if got := cfg.NextOpen(lga, "", time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC)); !got.IsZero() {
+		t.Errorf("Config.NextOpen() = %v, want zero time", got)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name: "success",
+			content: `{"windows": [{"site": "lga.*", "timezone": "Europe/Rome",
+				"days": ["Sat", "Sun"], "start": "01:00", "end": "05:30"}],
+				"blackouts": [{"start": "2019-01-01T00:00:00Z",
+				"end": "2019-01-02T00:00:00Z", "comment": "upgrade"}]}`,
+		},
+		{
+			name:    "invalid-json",
+			content: `{`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid-timezone",
+			content: `{"windows": [{"timezone": "Mars/Olympus", "start": "01:00", "end": "02:00"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid-day",
+			content: `{"windows": [{"days": ["Caturday"], "start": "01:00", "end": "02:00"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid-start",
+			content: `{"windows": [{"start": "1am", "end": "02:00"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid-end",
+			content: `{"windows": [{"start": "01:00", "end": "25:00"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid-site",
+			content: `{"windows": [{"site": "(", "start": "01:00", "end": "02:00"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "blackout-without-end",
+			content: `{"blackouts": [{"start": "2019-01-01T00:00:00Z"}]}`,
+			wantErr: true,
+		},
+		{
+			name: "blackout-end-before-start",
+			content: `{"blackouts": [{"start": "2019-01-02T00:00:00Z",
+				"end": "2019-01-01T00:00:00Z"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "blackout-invalid-site",
+			content: `{"blackouts": [{"site": "(", "start": "2019-01-01T00:00:00Z", "end": "2019-01-02T00:00:00Z"}]}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "schedule")
+			rtx.Must(err, "Cannot create temporary file")
+			defer os.Remove(f.Name())
+			_, err = f.WriteString(tt.content)
+			rtx.Must(err, "Cannot write temporary file")
+			f.Close()
+
+			_, err = LoadConfig(f.Name())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	_, err := LoadConfig("/this/does/not/exist")
+	if err == nil {
+		t.Errorf("LoadConfig() of a missing file did not fail")
+	}
+}
@@ -0,0 +1,115 @@
+package ticket
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultURL is the base URL of GitHub's API.
+const DefaultURL = "https://api.github.com"
+
+// Client is a client for a GitHub-compatible issues API.
+type Client struct {
+	baseURL string
+	repo    string
+	token   string
+	client  *http.Client
+}
+
+// NewClient returns a Client for the issues of repo ("owner/name") on the
+// API at baseURL. If token is not empty, it's sent with every request.
+func NewClient(c *http.Client, baseURL, repo, token string) *Client {
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		repo:    repo,
+		token:   token,
+		client:  c,
+	}
+}
+
+// issue is the subset of an issue's fields rebot uses.
+type issue struct {
+	Number int      `json:"number,omitempty"`
+	Title  string   `json:"title,omitempty"`
+	Body   string   `json:"body,omitempty"`
+	Labels []string `json:"labels,omitempty"`
+	State  string   `json:"state,omitempty"`
+}
+
+// comment is an issue comment.
+type comment struct {
+	Body string `json:"body"`
+}
+
+// Open opens an issue and returns its number.
+func (c *Client) Open(title, body string, labels []string) (int, error) {
+	var created issue
+	err := c.do(http.MethodPost, "/issues", issue{
+		Title:  title,
+		Body:   body,
+		Labels: labels,
+	}, &created)
+	if err != nil {
+		return 0, err
+	}
+	if created.Number == 0 {
+		return 0, fmt.Errorf("the response has no issue number")
+	}
+	return created.Number, nil
+}
+
+// Comment adds a comment to the issue.
+func (c *Client) Comment(number int, body string) error {
+	return c.do(http.MethodPost, "/issues/"+strconv.Itoa(number)+"/comments",
+		comment{Body: body}, nil)
+}
+
+// Close closes the issue.
+func (c *Client) Close(number int) error {
+	return c.do(http.MethodPatch, "/issues/"+strconv.Itoa(number),
+		issue{State: "closed"}, nil)
+}
+
+// do sends a request to the endpoint of the repository, with body encoded
+// as JSON, and decodes the JSON response into v if not nil.
+func (c *Client) do(method, endpoint string, body, v interface{}) error {
+	content, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+"/repos/"+c.repo+endpoint,
+		bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "token "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("issues API returned %s: %s", resp.Status,
+			strings.TrimSpace(string(content)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(content, v)
+}
@@ -0,0 +1,210 @@
+// Package ticket tracks the nodes that reboots do not bring back online in
+// a GitHub-compatible issues API, so that they get a hardware follow-up.
+package ticket
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/rebot/history"
+	"github.com/m-lab/rebot/node"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxEvents is the maximum number of events listed in a new issue.
+const maxEvents = 20
+
+var (
+	metricRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rebot_ticket_requests_total",
+			Help: "Total number of requests to the issues API by action and " +
+				"status.",
+		},
+		[]string{
+			"action",
+			"status",
+		},
+	)
+)
+
+// Tracker opens an issue for every node that is still offline after
+// threshold consecutive reboots, and closes it once the node is observed
+// online again. The issue numbers are stored in the history.
+type Tracker struct {
+	client    *Client
+	threshold int
+	labels    []string
+	events    *history.EventLog
+}
+
+// NewTracker returns a Tracker opening issues with the given labels via c.
+// If events is not nil, the node's reboot events are listed in the issue.
+func NewTracker(c *Client, threshold int, labels []string, events *history.EventLog) *Tracker {
+	return &Tracker{
+		client:    c,
+		threshold: threshold,
+		labels:    labels,
+		events:    events,
+	}
+}
+
+// Sync opens an issue for every node in the history that crossed the
+// threshold and has none yet, and closes the issues of the nodes observed
+// online after their last reboot. Failed requests are logged and retried on
+// the next call. Calling Sync on a nil Tracker is a no-op.
+func (t *Tracker) Sync(h map[string]node.History) {
+	if t == nil {
+		return
+	}
+
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		hist := h[name]
+		switch {
+		case hist.Issue == 0 && hist.Status == node.ObservedOffline &&
+			hist.Attempts >= t.threshold:
+			t.open(h, hist)
+		case hist.Issue != 0 && hist.Status == node.ObservedOnline &&
+			!hist.Recovered.IsZero():
+			text := fmt.Sprintf("%s was observed online again at %s.", hist.Name,
+				formatTime(hist.Recovered))
+			if t.Close(hist, text) {
+				hist.Issue = 0
+				h[name] = hist
+			}
+		}
+	}
+}
+
+// Comment adds a comment to the issue of the node described by hist, if
+// any. Errors are logged. Calling Comment on a nil Tracker is a no-op.
+func (t *Tracker) Comment(hist node.History, text string) {
+	if t == nil || hist.Issue == 0 {
+		return
+	}
+
+	err := t.client.Comment(hist.Issue, text)
+	record("comment", err)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"machine": hist.Name,
+			"issue": hist.Issue}).Error("Cannot comment on the issue.")
+	}
+}
+
+func (t *Tracker) open(h map[string]node.History, hist node.History) {
+	title := fmt.Sprintf("%s is offline after %d reboots", hist.Name, hist.Attempts)
+	number, err := t.client.Open(title, t.body(hist), t.labels)
+	record("open", err)
+	if err != nil {
+		log.WithError(err).WithField("machine", hist.Name).Error("Cannot open an issue.")
+		return
+	}
+
+	log.WithFields(log.Fields{"machine": hist.Name, "issue": number}).Info("Issue opened.")
+	hist.Issue = number
+	h[hist.Name] = hist
+}
+
+// Close comments on the issue of the node described by hist, if any, with
+// text and closes it. It returns true if there is no issue left open.
+// Errors are logged. Calling Close on a nil Tracker is a no-op.
+func (t *Tracker) Close(hist node.History, text string) bool {
+	if t == nil || hist.Issue == 0 {
+		return true
+	}
+
+	t.Comment(hist, text)
+	err := t.client.Close(hist.Issue)
+	record("close", err)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"machine": hist.Name,
+			"issue": hist.Issue}).Error("Cannot close the issue.")
+		return false
+	}
+
+	log.WithFields(log.Fields{"machine": hist.Name, "issue": hist.Issue}).Info("Issue closed.")
+	return true
+}
+
+// body returns the body of the issue for the node described by hist, with
+// its reboot history and the reasons for the reboots.
+func (t *Tracker) body(hist node.History) string {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "rebot rebooted `%s` %d times in a row, but it's still offline "+
+		"and may need a hardware follow-up.\n\n", hist.Name, hist.Attempts)
+	fmt.Fprintf(b, "- Site: %s\n", hist.Site)
+	fmt.Fprintf(b, "- Last reboot: %s\n", formatTime(hist.LastReboot))
+	fmt.Fprintf(b, "- Reasons: %s\n", strings.Join(hist.Reasons, ", "))
+	if hist.Error != "" {
+		fmt.Fprintf(b, "- Last error: %s (%s)\n", hist.Error, formatTime(hist.LastAttempt))
+	}
+	if hist.NeedsHuman {
+		fmt.Fprint(b, "- rebot gave up: the machine won't be rebooted again until "+
+			"it's cleared.\n")
+	}
+
+	if t.events == nil {
+		return b.String()
+	}
+	events, err := t.events.Read(history.Query{Machine: hist.Name})
+	if err != nil {
+		log.WithError(err).WithField("machine", hist.Name).Warn("Cannot read the events.")
+		return b.String()
+	}
+	rows := make([]history.Event, 0, len(events))
+	for _, e := range events {
+		switch e.Type {
+		case history.EventRebootSucceeded, history.EventRebootFailed,
+			history.EventManualReboot, history.EventRecovered:
+			rows = append(rows, e)
+		}
+	}
+	if len(rows) > maxEvents {
+		rows = rows[len(rows)-maxEvents:]
+	}
+	if len(rows) == 0 {
+		return b.String()
+	}
+
+	fmt.Fprintf(b, "\n### Reboot history\n\n")
+	fmt.Fprintf(b, "| Time | Event | Details |\n|---|---|---|\n")
+	for _, e := range rows {
+		details := strings.Join(e.Reasons, ", ")
+		if e.Reason != "" {
+			details = e.Reason
+		}
+		if e.Error != "" {
+			details = e.Error
+		}
+		fmt.Fprintf(b, "| %s | %s | %s |\n", formatTime(e.Time), e.Type,
+			strings.Replace(details, "|", "\\|", -1))
+	}
+	return b.String()
+}
+
+// record counts a request to the issues API.
+func record(action string, err error) {
+	status := "success"
+	if err != nil {
+		status = "failure"
+	}
+	metricRequests.WithLabelValues(action, status).Inc()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
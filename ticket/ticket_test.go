@@ -0,0 +1,242 @@
+package ticket
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/rebot/history"
+	"github.com/m-lab/rebot/node"
+)
+
+const (
+	testRepo  = "m-lab/ops-tracker"
+	testToken = "secret"
+)
+
+// fakeIssues is a fake GitHub-compatible issues API for testRepo. late
+// counts the comments added to closed issues.
+type fakeIssues struct {
+	issues   map[int]*issue
+	comments map[int][]string
+	late     int
+	fail     bool
+
+	mu sync.Mutex
+}
+
+func newFakeIssues() *fakeIssues {
+	return &fakeIssues{
+		issues:   map[int]*issue{},
+		comments: map[int][]string{},
+	}
+}
+
+func (f *fakeIssues) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if req.Header.Get("Authorization") != "token "+testToken {
+		http.Error(rw, `{"message": "Bad credentials"}`, http.StatusUnauthorized)
+		return
+	}
+	if f.fail {
+		http.Error(rw, `{"message": "Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/repos/"+testRepo+"/issues")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	var in issue
+	rtx.Must(json.NewDecoder(req.Body).Decode(&in), "Cannot decode request")
+
+	switch {
+	case req.Method == http.MethodPost && path == "":
+		in.Number = len(f.issues) + 1
+		in.State = "open"
+		f.issues[in.Number] = &in
+		rw.WriteHeader(http.StatusCreated)
+		rtx.Must(json.NewEncoder(rw).Encode(in), "Cannot encode response")
+	case req.Method == http.MethodPost && len(parts) == 2 && parts[1] == "comments":
+		number, _ := strconv.Atoi(parts[0])
+		if f.issues[number] == nil {
+			http.NotFound(rw, req)
+			return
+		}
+		f.comments[number] = append(f.comments[number], in.Body)
+		if f.issues[number].State == "closed" {
+			f.late++
+		}
+		rw.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodPatch && len(parts) == 1:
+		number, _ := strconv.Atoi(parts[0])
+		if f.issues[number] == nil {
+			http.NotFound(rw, req)
+			return
+		}
+		f.issues[number].State = in.State
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func TestClient(t *testing.T) {
+	fake := newFakeIssues()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	c := NewClient(http.DefaultClient, srv.URL+"/", testRepo, testToken)
+	number, err := c.Open("title", "body", []string{"rebot"})
+	if err != nil || number != 1 {
+		t.Fatalf("Client.Open() = %d, %v, want 1, nil", number, err)
+	}
+	if got := fake.issues[1]; got.Title != "title" || got.Body != "body" ||
+		len(got.Labels) != 1 || got.Labels[0] != "rebot" {
+		t.Errorf("Client.Open() created %+v", got)
+	}
+
+	if err = c.Comment(1, "comment"); err != nil {
+		t.Errorf("Client.Comment() error = %v", err)
+	}
+	if got := fake.comments[1]; len(got) != 1 || got[0] != "comment" {
+		t.Errorf("Client.Comment() added %v", got)
+	}
+
+	if err = c.Close(1); err != nil || fake.issues[1].State != "closed" {
+		t.Errorf("Client.Close() = %v, state = %s", err, fake.issues[1].State)
+	}
+
+	if err = c.Comment(42, "comment"); err == nil {
+		t.Errorf("Client.Comment() on a missing issue did not fail")
+	}
+	if err = c.Close(42); err == nil {
+		t.Errorf("Client.Close() on a missing issue did not fail")
+	}
+
+	c = NewClient(http.DefaultClient, srv.URL, testRepo, "wrong")
+	if _, err = c.Open("title", "body", nil); err == nil ||
+		!strings.Contains(err.Error(), "Bad credentials") {
+		t.Errorf("Client.Open() with a wrong token = %v", err)
+	}
+
+	c = NewClient(http.DefaultClient, "http://invalid.invalid:-1", testRepo, testToken)
+	if _, err = c.Open("title", "body", nil); err == nil {
+		t.Errorf("Client.Open() to an invalid URL did not fail")
+	}
+}
+
+func TestTracker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ticket")
+	rtx.Must(err, "Cannot create temporary directory")
+	defer os.RemoveAll(dir)
+
+	fake := newFakeIssues()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	offline := node.NewHistory("mlab1.lga0t.measurement-lab.org", "lga0t", time.Now())
+	offline.Status = node.ObservedOffline
+	offline.Attempts = 3
+	offline.Reasons = []string{"offline"}
+
+	events := history.NewEventLog(filepath.Join(dir, "events.jsonl"), 1024*1024, 1)
+	e := history.NewEvent(history.EventRebootSucceeded, offline.Node)
+	e.Reasons = []string{"offline", "no|pipes"}
+	rtx.Must(events.Append(e), "Cannot write the event log")
+
+	h := map[string]node.History{
+		offline.Name: offline,
+		"mlab2.lga0t.measurement-lab.org": {
+			Node:     node.Node{Name: "mlab2.lga0t.measurement-lab.org", Site: "lga0t"},
+			Status:   node.ObservedOffline,
+			Attempts: 2,
+		},
+		"mlab3.lga0t.measurement-lab.org": {
+			Node:     node.Node{Name: "mlab3.lga0t.measurement-lab.org", Site: "lga0t"},
+			Status:   node.ObservedOnline,
+			Attempts: 3,
+		},
+	}
+
+	// Failed requests are retried on the next Sync.
+	fake.fail = true
+	tracker := NewTracker(NewClient(http.DefaultClient, srv.URL, testRepo, testToken),
+		3, []string{"rebot"}, events)
+	tracker.Sync(h)
+	if h[offline.Name].Issue != 0 {
+		t.Fatalf("Sync() recorded an issue that was not opened")
+	}
+	fake.fail = false
+
+	// Only the node that crossed the threshold gets an issue, once.
+	tracker.Sync(h)
+	tracker.Sync(h)
+	if len(fake.issues) != 1 || h[offline.Name].Issue != 1 {
+		t.Fatalf("Sync() opened %d issues, history = %+v", len(fake.issues), h)
+	}
+	got := fake.issues[1]
+	for _, want := range []string{offline.Name, "3 times", "Reasons: offline",
+		"reboot-succeeded", `no\|pipes`} {
+		if !strings.Contains(got.Title+got.Body, want) {
+			t.Errorf("Sync() opened an issue without %q:\n%s\n%s", want, got.Title, got.Body)
+		}
+	}
+
+	tracker.Comment(h[offline.Name], "rebooted again")
+	tracker.Comment(h["mlab2.lga0t.measurement-lab.org"], "no issue")
+	if c := fake.comments[1]; len(c) != 1 || c[0] != "rebooted again" {
+		t.Errorf("Comment() added %v", c)
+	}
+
+	// The issue is only closed once the node is observed online after its
+	// last reboot.
+	online := h[offline.Name]
+	online.Status = node.ObservedOnline
+	h[offline.Name] = online
+	tracker.Sync(h)
+	if fake.issues[1].State == "closed" || h[offline.Name].Issue != 1 {
+		t.Errorf("Sync() closed the issue of a node not recovered: %+v", h[offline.Name])
+	}
+	online.Recovered = time.Now()
+	h[offline.Name] = online
+	tracker.Sync(h)
+	if fake.issues[1].State != "closed" || h[offline.Name].Issue != 0 {
+		t.Errorf("Sync() did not close the issue: %+v, %+v", fake.issues[1], h[offline.Name])
+	}
+	if c := fake.comments[1]; len(c) != 2 || !strings.Contains(c[1], "online again") ||
+		fake.late != 0 {
+		t.Errorf("Sync() did not comment on the issue before closing it: %v", c)
+	}
+
+	// Close closes the issue of a cleared node.
+	cleared := h["mlab2.lga0t.measurement-lab.org"]
+	cleared.Issue = 1
+	fake.issues[1].State = "open"
+	if !tracker.Close(cleared, "cleared") || fake.issues[1].State != "closed" {
+		t.Errorf("Close() did not close the issue: %+v", fake.issues[1])
+	}
+	if !tracker.Close(h["mlab2.lga0t.measurement-lab.org"], "no issue") {
+		t.Errorf("Close() of a node without an issue = false")
+	}
+
+	// A nil Tracker does nothing.
+	var nilTracker *Tracker
+	nilTracker.Sync(h)
+	nilTracker.Comment(h[offline.Name], "nothing")
+	nilTracker.Close(cleared, "nothing")
+}
+
+func TestMetrics(t *testing.T) {
+	metricRequests.WithLabelValues("x", "x")
+	promtest.LintMetrics(t)
+}